@@ -0,0 +1,236 @@
+// Package acl implements IP address allow and deny lists
+package acl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Snawoot/udpierce/proto"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ipList []*net.IPNet
+
+func (l ipList) Contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if strings.IndexByte(s, '/') < 0 {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Bad IP address: %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// Reads CIDR list from file. One prefix or plain address per line,
+// empty lines and lines starting with '#' are ignored.
+func loadIPList(filename string) (ipList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res ipList
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		n, err := parseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		res = append(res, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+type aclSource struct {
+	filename string
+	mtime    time.Time
+	list     ipList
+}
+
+func (s *aclSource) load() error {
+	if s.filename == "" {
+		return nil
+	}
+	fi, err := os.Stat(s.filename)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.mtime) {
+		return nil
+	}
+	list, err := loadIPList(s.filename)
+	if err != nil {
+		return err
+	}
+	s.list = list
+	s.mtime = fi.ModTime()
+	return nil
+}
+
+// ACL holds IP address allow and deny lists loaded from files. Deny list
+// takes precedence. Non-empty allow list rejects any address not matched
+// by it, empty one is the same as no allow list.
+type ACL struct {
+	allow  aclSource
+	deny   aclSource
+	mux    sync.RWMutex
+	logger proto.Logger
+}
+
+// Loads lists from files. Empty filename means list is not used.
+// Returns nil ACL, which allows everything, if both filenames are empty.
+func New(allowfile, denyfile string, logger proto.Logger) (*ACL, error) {
+	if allowfile == "" && denyfile == "" {
+		return nil, nil
+	}
+	if logger == nil {
+		logger = proto.NopLogger{}
+	}
+	acl := &ACL{
+		allow:  aclSource{filename: allowfile},
+		deny:   aclSource{filename: denyfile},
+		logger: logger,
+	}
+	if err := acl.allow.load(); err != nil {
+		return nil, err
+	}
+	if err := acl.deny.load(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Periodically reloads changed list files until context is done
+func (a *ACL) Watch(ctx context.Context, interval time.Duration) {
+	if a == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.Reload()
+		}
+	}
+}
+
+// Re-reads list files if they were changed. On error previous lists
+// stay in effect.
+func (a *ACL) Reload() {
+	for _, src := range []*aclSource{&a.allow, &a.deny} {
+		a.mux.RLock()
+		cur := *src
+		a.mux.RUnlock()
+		if err := cur.load(); err != nil {
+			a.logger.Error("ACL reload from %s failed: %v", cur.filename, err)
+			continue
+		}
+		a.mux.Lock()
+		if !cur.mtime.Equal(src.mtime) {
+			a.logger.Info("ACL list %s reloaded: %d entries", cur.filename, len(cur.list))
+		}
+		*src = cur
+		a.mux.Unlock()
+	}
+}
+
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	if a.deny.list.Contains(ip) {
+		return false
+	}
+	if len(a.allow.list) > 0 && !a.allow.list.Contains(ip) {
+		return false
+	}
+	return true
+}
+
+// Checks peer address. Unix socket peers are local and always allowed.
+func (a *ACL) AllowedAddr(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+	ip, err := addrIP(addr)
+	if err != nil {
+		return false
+	}
+	return a.Allowed(ip)
+}
+
+// Checks address in host:port form
+func (a *ACL) AllowedHostPort(hostport string) bool {
+	if a == nil {
+		return true
+	}
+	ip, err := hostPortIP(hostport)
+	if err != nil {
+		return false
+	}
+	return a.Allowed(ip)
+}
+
+func addrIP(addr net.Addr) (net.IP, error) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, nil
+	case *net.TCPAddr:
+		return a.IP, nil
+	case *net.IPAddr:
+		return a.IP, nil
+	}
+	return hostPortIP(addr.String())
+}
+
+func hostPortIP(hostport string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("Address is not an IP address")
+	}
+	return ip, nil
+}
@@ -0,0 +1,182 @@
+package acl
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCIDR(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "192.0.2.1", want: "192.0.2.1/32"},
+		{in: "192.0.2.0/24", want: "192.0.2.0/24"},
+		{in: "192.0.2.77/24", want: "192.0.2.0/24"},
+		{in: "::ffff:192.0.2.1", want: "192.0.2.1/32"},
+		{in: "2001:db8::1", want: "2001:db8::1/128"},
+		{in: "2001:db8::/32", want: "2001:db8::/32"},
+		{in: "0.0.0.0/0", want: "0.0.0.0/0"},
+		{in: "192.0.2.1/33", wantErr: true},
+		{in: "192.0.2", wantErr: true},
+		{in: "example.com", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, c := range cases {
+		n, err := parseCIDR(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %v, want error", c.in, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.in, err)
+			continue
+		}
+		if n.String() != c.want {
+			t.Errorf("%q: got %v, want %s", c.in, n, c.want)
+		}
+	}
+}
+
+func writeList(t *testing.T, filename, content string) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	allowFile := filepath.Join(dir, "allow")
+	emptyFile := filepath.Join(dir, "empty")
+	denyFile := filepath.Join(dir, "deny")
+	writeList(t, allowFile, "# office\n192.0.2.0/24\n\n2001:db8::/32 # v6\n")
+	writeList(t, emptyFile, "# nothing here\n\n")
+	writeList(t, denyFile, "192.0.2.66\n")
+
+	cases := []struct {
+		name, allow, deny string
+		allowed, denied   []string
+	}{
+		{
+			name:    "allow only",
+			allow:   allowFile,
+			allowed: []string{"192.0.2.1", "192.0.2.66", "2001:db8::5", "::ffff:192.0.2.9"},
+			denied:  []string{"198.51.100.1", "2001:db9::1"},
+		},
+		{
+			name:    "deny only",
+			deny:    denyFile,
+			allowed: []string{"192.0.2.1", "198.51.100.1"},
+			denied:  []string{"192.0.2.66"},
+		},
+		{
+			name:    "deny takes precedence",
+			allow:   allowFile,
+			deny:    denyFile,
+			allowed: []string{"192.0.2.1", "2001:db8::5"},
+			denied:  []string{"192.0.2.66", "198.51.100.1"},
+		},
+		{
+			name:    "empty allow list",
+			allow:   emptyFile,
+			deny:    denyFile,
+			allowed: []string{"192.0.2.1", "198.51.100.1"},
+			denied:  []string{"192.0.2.66"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, err := New(c.allow, c.deny, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range c.allowed {
+				if !a.Allowed(net.ParseIP(s)) {
+					t.Errorf("%s denied", s)
+				}
+			}
+			for _, s := range c.denied {
+				if a.Allowed(net.ParseIP(s)) {
+					t.Errorf("%s allowed", s)
+				}
+			}
+		})
+	}
+
+	var none *ACL
+	if !none.Allowed(net.ParseIP("192.0.2.1")) || !none.AllowedHostPort("192.0.2.1:53") {
+		t.Error("nil ACL denies address")
+	}
+	a, _ := New(allowFile, denyFile, nil)
+	if !a.AllowedAddr(&net.UnixAddr{Name: "@", Net: "unix"}) {
+		t.Error("unix peer denied")
+	}
+	if !a.AllowedAddr(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}) ||
+		a.AllowedAddr(&net.UDPAddr{IP: net.ParseIP("192.0.2.66"), Port: 1}) {
+		t.Error("peer address checked wrong")
+	}
+	if a.AllowedHostPort("example.com:53") || a.AllowedHostPort("192.0.2.1") {
+		t.Error("destination without IP address allowed")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	denyFile := filepath.Join(dir, "deny")
+	writeList(t, denyFile, "192.0.2.1\n")
+	mtime := time.Now().Add(-time.Hour)
+	os.Chtimes(denyFile, mtime, mtime)
+	a, err := New("", denyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+
+	// Unchanged mtime means file isn't read again
+	writeList(t, denyFile, "192.0.2.2\n")
+	os.Chtimes(denyFile, mtime, mtime)
+	a.Reload()
+	if a.Allowed(ip1) || !a.Allowed(ip2) {
+		t.Fatal("list reloaded without mtime change")
+	}
+
+	mtime = mtime.Add(time.Minute)
+	os.Chtimes(denyFile, mtime, mtime)
+	a.Reload()
+	if !a.Allowed(ip1) || a.Allowed(ip2) {
+		t.Fatal("list isn't reloaded after mtime change")
+	}
+
+	// Broken file keeps previous list in effect
+	writeList(t, denyFile, "bogus\n")
+	mtime = mtime.Add(time.Minute)
+	os.Chtimes(denyFile, mtime, mtime)
+	a.Reload()
+	if a.Allowed(ip2) {
+		t.Fatal("previous list dropped after failed reload")
+	}
+
+	// Fixed file is picked up on next reload
+	writeList(t, denyFile, "192.0.2.1\n")
+	mtime = mtime.Add(time.Minute)
+	os.Chtimes(denyFile, mtime, mtime)
+	a.Reload()
+	if a.Allowed(ip1) || !a.Allowed(ip2) {
+		t.Fatal("list isn't reloaded after fix")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Snawoot/udpierce/pki"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const caUsage = `Usage: %s ca COMMAND [OPTIONS] [ARGS]
+
+Commands:
+  init                  create new certificate authority
+  issue-client NAME     issue client certificate with common name NAME
+  issue-server HOST...  issue server certificate for hostnames and IP addresses
+  revoke SERIAL|FILE    revoke certificate by serial number or certificate file
+
+Run "%s ca COMMAND -h" for command options.
+`
+
+func ca_usage() {
+	fmt.Fprintf(os.Stderr, caUsage, os.Args[0], os.Args[0])
+}
+
+// Handles "ca" subcommands. Returns exit code.
+func ca_main(argv []string) int {
+	if len(argv) < 1 {
+		ca_usage()
+		return 2
+	}
+	cmd, argv := argv[0], argv[1:]
+	fs := flag.NewFlagSet("ca "+cmd, flag.ExitOnError)
+	dir := fs.String("dir", "udpierce-ca", "CA directory")
+	var (
+		name     *string
+		out      *string
+		validity *time.Duration
+	)
+	switch cmd {
+	case "init":
+		name = fs.String("name", "udpierce CA", "CA certificate common name")
+		validity = fs.Duration("validity", pki.DEFAULT_CA_VALIDITY, "CA certificate lifetime")
+	case "issue-client", "issue-server":
+		out = fs.String("out", "", "output file name prefix, certificate and key are written "+
+			"to PREFIX.pem and PREFIX.key. Defaults to first argument")
+		validity = fs.Duration("validity", pki.DEFAULT_CERT_VALIDITY, "certificate lifetime")
+	case "revoke":
+	case "-h", "-help", "--help", "help":
+		ca_usage()
+		return 0
+	default:
+		perror(fmt.Sprintf("Unknown ca command %q", cmd))
+		ca_usage()
+		return 2
+	}
+	fs.Parse(argv)
+
+	if cmd == "init" {
+		ca, err := pki.InitCA(*dir, *name, *validity)
+		if err != nil {
+			perror(fmt.Sprintf("CA creation failed: %v", err))
+			return 3
+		}
+		fmt.Printf("Created CA %q in %s\n", ca.Certificate().Subject.CommonName, *dir)
+		fmt.Printf("Server option: -cafile %s -crl %s\n",
+			filepath.Join(*dir, pki.CA_CERT_FILE), filepath.Join(*dir, pki.CRL_FILE))
+		fmt.Printf("Client option: -cafile %s\n", filepath.Join(*dir, pki.CA_CERT_FILE))
+		return 0
+	}
+
+	if fs.NArg() < 1 {
+		perror("Not enough arguments")
+		fs.Usage()
+		return 2
+	}
+	ca, err := pki.LoadCA(*dir)
+	if err != nil {
+		perror(fmt.Sprintf("CA loading failed: %v", err))
+		return 3
+	}
+
+	if cmd == "revoke" {
+		if fs.NArg() != 1 {
+			perror("Exactly one serial number or certificate file expected")
+			return 2
+		}
+		serial, err := revocationSerial(fs.Arg(0))
+		if err != nil {
+			perror(err.Error())
+			return 2
+		}
+		if err := ca.Revoke(serial); err != nil {
+			perror(fmt.Sprintf("Revocation failed: %v", err))
+			return 3
+		}
+		fmt.Printf("Revoked serial %s\n", pki.FormatSerial(serial))
+		return 0
+	}
+
+	var certPEM, keyPEM []byte
+	if cmd == "issue-client" {
+		if fs.NArg() != 1 {
+			perror("Exactly one client name expected")
+			return 2
+		}
+		certPEM, keyPEM, err = ca.IssueClient(fs.Arg(0), *validity)
+	} else {
+		certPEM, keyPEM, err = ca.IssueServer(fs.Args(), *validity)
+	}
+	if err != nil {
+		perror(fmt.Sprintf("Certificate issuance failed: %v", err))
+		return 3
+	}
+	prefix := *out
+	if prefix == "" {
+		prefix = fs.Arg(0)
+	}
+	if err := ioutil.WriteFile(prefix+".key", keyPEM, 0600); err != nil {
+		perror(err.Error())
+		return 3
+	}
+	if err := ioutil.WriteFile(prefix+".pem", certPEM, 0644); err != nil {
+		perror(err.Error())
+		return 3
+	}
+	cert, err := pki.LoadCert(prefix + ".pem")
+	if err != nil {
+		perror(err.Error())
+		return 3
+	}
+	fmt.Printf("Issued certificate %s.pem with key %s.key, serial %s, valid until %s\n",
+		prefix, prefix, pki.FormatSerial(cert.SerialNumber), cert.NotAfter.Format(time.RFC3339))
+	return 0
+}
+
+// Takes serial number either from certificate file or from argument
+// itself
+func revocationSerial(arg string) (*big.Int, error) {
+	if _, err := os.Stat(arg); err == nil {
+		cert, err := pki.LoadCert(arg)
+		if err != nil {
+			return nil, err
+		}
+		return cert.SerialNumber, nil
+	}
+	return pki.ParseSerial(arg)
+}
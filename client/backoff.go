@@ -0,0 +1,115 @@
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const DEFAULT_MAX_BACKOFF = time.Minute
+
+// Connection lasted at least that long is considered stable: next
+// attempt after its failure is made immediately
+const STABLE_CONN_TIME = 30 * time.Second
+
+const (
+	DEFAULT_BREAKER_THRESHOLD = 5
+	DEFAULT_BREAKER_TIMEOUT   = 10 * time.Second
+)
+
+// Returned by dials short-circuited while server is known to be down
+var ErrCircuitOpen = errors.New("server is down, connection attempts are suspended")
+
+var (
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterMux  sync.Mutex
+)
+
+// backoff computes delays between connection attempts. Delay doubles
+// with each failure up to maximum and is randomized, so clients don't
+// reconnect in synchronized waves.
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+// Returns delay before next attempt
+func (b *backoff) next() time.Duration {
+	// Shift is checked against maximum beforehand, so it can't overflow
+	d := b.max
+	if b.attempt < 63 && b.base <= b.max>>b.attempt {
+		d = b.base << b.attempt
+		b.attempt++
+	}
+	// Equal jitter: delay is random in [d/2, d)
+	jitterMux.Lock()
+	defer jitterMux.Unlock()
+	return d/2 + time.Duration(jitterRand.Int63n(int64(d/2)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// breaker suspends connection attempts for timeout after threshold of
+// consecutive failures. Once timeout expires, single trial attempt is
+// allowed: its success resumes connections, failure suspends them again.
+type breaker struct {
+	threshold uint
+	timeout   time.Duration
+	failures  uint
+	openUntil time.Time
+	trial     bool
+	mux       sync.Mutex
+}
+
+// Reports whether connection attempt may be made and whether it is
+// trial one. Each allowed attempt has to be followed by call of success,
+// failure or cancelled.
+func (b *breaker) allow() (ok, trial bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.failures < b.threshold {
+		return true, false
+	}
+	if b.trial || time.Now().Before(b.openUntil) {
+		return false, false
+	}
+	b.trial = true
+	return true, true
+}
+
+func (b *breaker) success() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+// Registers failed attempt. Returns true if it opened circuit.
+func (b *breaker) failure(trial bool) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.failures++
+	if trial {
+		b.trial = false
+	}
+	if !trial && b.failures != b.threshold {
+		return false
+	}
+	b.openUntil = time.Now().Add(b.timeout)
+	return true
+}
+
+// Releases attempt which was interrupted without telling anything
+// about server
+func (b *breaker) cancelled(trial bool) {
+	if !trial {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.trial = false
+}
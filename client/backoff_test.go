@@ -0,0 +1,139 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffBounds(t *testing.T) {
+	cases := []struct {
+		name      string
+		base, max time.Duration
+	}{
+		{"default", 5 * time.Second, DEFAULT_MAX_BACKOFF},
+		{"tiny base", time.Nanosecond, time.Hour},
+		{"base above max", time.Minute, time.Second},
+		{"equal", time.Second, time.Second},
+		{"huge max", time.Second, time.Duration(1<<63 - 1)},
+		{"zero", 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := backoff{base: c.base, max: c.max}
+			ceil := c.base
+			if ceil > c.max {
+				ceil = c.max
+			}
+			for i := 0; i < 200; i++ {
+				d := b.next()
+				if d < ceil/2 || d > ceil {
+					t.Fatalf("attempt %d: delay %v out of [%v, %v]", i, d, ceil/2, ceil)
+				}
+				if ceil <= c.max/2 {
+					ceil *= 2
+				} else {
+					ceil = c.max
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := backoff{base: time.Second, max: time.Minute}
+	for i := 0; i < 10; i++ {
+		b.next()
+	}
+	b.reset()
+	if d := b.next(); d > time.Second {
+		t.Fatalf("delay after reset %v exceeds base", d)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	type step struct {
+		op        string // allow, success, failure, cancelled, wait
+		trial     bool
+		wantOK    bool
+		wantTrial bool
+		wantOpen  bool
+	}
+	const timeout = 20 * time.Millisecond
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{"stays closed below threshold", []step{
+			{op: "allow", wantOK: true},
+			{op: "failure"},
+			{op: "allow", wantOK: true},
+			{op: "failure", wantOpen: true},
+			{op: "allow"},
+		}},
+		{"success resets failures", []step{
+			{op: "failure"},
+			{op: "success"},
+			{op: "failure"},
+			{op: "allow", wantOK: true},
+		}},
+		{"single trial after timeout", []step{
+			{op: "failure"},
+			{op: "failure", wantOpen: true},
+			{op: "allow"},
+			{op: "wait"},
+			{op: "allow", wantOK: true, wantTrial: true},
+			{op: "allow"},
+			{op: "success"},
+			{op: "allow", wantOK: true},
+		}},
+		{"failed trial reopens", []step{
+			{op: "failure"},
+			{op: "failure", wantOpen: true},
+			{op: "wait"},
+			{op: "allow", wantOK: true, wantTrial: true},
+			{op: "failure", trial: true, wantOpen: true},
+			{op: "allow"},
+			{op: "wait"},
+			{op: "allow", wantOK: true, wantTrial: true},
+		}},
+		{"cancelled trial is released", []step{
+			{op: "failure"},
+			{op: "failure", wantOpen: true},
+			{op: "wait"},
+			{op: "allow", wantOK: true, wantTrial: true},
+			{op: "cancelled", trial: true},
+			{op: "allow", wantOK: true, wantTrial: true},
+		}},
+		{"cancelled regular attempt changes nothing", []step{
+			{op: "allow", wantOK: true},
+			{op: "cancelled"},
+			{op: "failure"},
+			{op: "allow", wantOK: true},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := &breaker{threshold: 2, timeout: timeout}
+			for i, s := range c.steps {
+				switch s.op {
+				case "allow":
+					ok, trial := b.allow()
+					if ok != s.wantOK || trial != s.wantTrial {
+						t.Fatalf("step %d: allow() = %v, %v; want %v, %v",
+							i, ok, trial, s.wantOK, s.wantTrial)
+					}
+				case "success":
+					b.success()
+				case "failure":
+					if open := b.failure(s.trial); open != s.wantOpen {
+						t.Fatalf("step %d: failure() = %v; want %v", i, open, s.wantOpen)
+					}
+				case "cancelled":
+					b.cancelled(s.trial)
+				case "wait":
+					time.Sleep(timeout + 10*time.Millisecond)
+				}
+			}
+		})
+	}
+}
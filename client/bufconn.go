@@ -0,0 +1,16 @@
+package client
+
+import (
+	"bufio"
+	"net"
+)
+
+// Connection with reads going through buffered reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,287 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/Snawoot/udpierce/proto"
+	"github.com/Snawoot/udpierce/resolver"
+	"golang.org/x/sync/semaphore"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+type ConnFactoryOptions struct {
+	// Server address in host:port form
+	Address string
+	// Connect timeout. Defaults to DEFAULT_TIMEOUT.
+	Timeout time.Duration
+	// Use plain TCP connections instead of TLS
+	DisableTLS bool
+	// Ready TLS config. If set, file and server name options are ignored.
+	TLSConfig *tls.Config
+	// Client certificate and key files for TLS authentication
+	CertFile, KeyFile string
+	// File with CA certificates to use instead of system ones
+	CAFile string
+	// Don't check hostname in server certificate. Requires CAFile or
+	// PinSHA256.
+	SkipHostnameCheck bool
+	// SHA-256 hashes of allowed server public keys, see ParsePinSHA256.
+	// Checked in addition to chain verification. With SkipHostnameCheck
+	// and without CAFile only server certificate key is checked.
+	PinSHA256 [][]byte
+	// Hostname to expect in server certificate instead of Address host
+	TLSServerName string
+	// Concurrency limit for connection attempts. Defaults to GOMAXPROCS.
+	Dialers uint
+	// Resolve server hostname once on construction. Otherwise it is
+	// resolved on each connection attempt.
+	ResolveOnce bool
+	// Resolves server hostname, optional. Defaults to system resolver
+	// with cache.
+	Resolver *resolver.Resolver
+	// Setup of connection sockets, optional. With source address only
+	// server addresses of same family are used.
+	SocketOptions *proto.SocketOptions
+	// Consecutive connection failures after which server is considered
+	// down and dials fail immediately. Defaults to
+	// DEFAULT_BREAKER_THRESHOLD.
+	BreakerThreshold uint
+	// Time for which dials fail immediately once server is considered
+	// down. Defaults to DEFAULT_BREAKER_TIMEOUT.
+	BreakerTimeout time.Duration
+	// ClientHello profile, see PROFILE_* constants. Defaults to PROFILE_GO.
+	TLSProfile string
+	// Handshake parameters, optional. Override ones of profile.
+	TLSParams *proto.TLSParams
+	// Performs client TLS handshake, optional. Allows to use alternative
+	// TLS implementation. Defaults to crypto/tls.
+	TLSHandshake TLSHandshakeFunc
+	Logger       proto.Logger
+}
+
+// TLSHandshakeFunc wraps connection into TLS client using given config
+// and completes handshake
+type TLSHandshakeFunc func(conn net.Conn, cfg *tls.Config) (net.Conn, error)
+
+func stdTLSHandshake(conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+type ConnFactory struct {
+	addr       string
+	host       string
+	port       int
+	ips        []net.IP
+	resolver   *resolver.Resolver
+	sockopts   *proto.SocketOptions
+	breaker    *breaker
+	lastGood   net.IP
+	lastGoodMu sync.Mutex
+	timeout    time.Duration
+	tlsEnabled bool
+	tlsConfig  *tls.Config
+	handshake  TLSHandshakeFunc
+	sem        *semaphore.Weighted
+	logger     proto.Logger
+}
+
+func NewConnFactory(opts ConnFactoryOptions) (*ConnFactory, error) {
+	var tlsConfig *tls.Config
+	address := opts.Address
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = proto.NopLogger{}
+	}
+	breakerThreshold := opts.BreakerThreshold
+	if breakerThreshold < 1 {
+		breakerThreshold = DEFAULT_BREAKER_THRESHOLD
+	}
+	breakerTimeout := opts.BreakerTimeout
+	if breakerTimeout <= 0 {
+		breakerTimeout = DEFAULT_BREAKER_TIMEOUT
+	}
+	dialers := opts.Dialers
+	if dialers < 1 {
+		dialers = uint(runtime.GOMAXPROCS(0))
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.DisableTLS {
+		tlsConfig = opts.TLSConfig
+		if tlsConfig == nil {
+			cfg_servername := host
+			if opts.TLSServerName != "" {
+				cfg_servername = opts.TLSServerName
+			}
+			tlsConfig, err = makeClientTLSConfig(cfg_servername,
+				opts.CertFile, opts.KeyFile, opts.CAFile,
+				!opts.SkipHostnameCheck, opts.PinSHA256)
+			if err != nil {
+				return nil, err
+			}
+			profile, err := TLSProfile(opts.TLSProfile)
+			if err != nil {
+				return nil, err
+			}
+			profile.Merge(opts.TLSParams).Apply(tlsConfig)
+		}
+	}
+	handshake := opts.TLSHandshake
+	if handshake == nil {
+		handshake = stdTLSHandshake
+	}
+	res := opts.Resolver
+	if res == nil {
+		res, err = resolver.New(resolver.Options{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var ips []net.IP
+	if opts.ResolveOnce {
+		for i := 0; i < RESOLVE_ATTEMPTS; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			ips, err = res.LookupIP(ctx, host)
+			cancel()
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ConnFactory{
+		addr:     address,
+		host:     host,
+		port:     port,
+		ips:      ips,
+		resolver: res,
+		sockopts: opts.SocketOptions,
+		breaker: &breaker{
+			threshold: breakerThreshold,
+			timeout:   breakerTimeout,
+		},
+		timeout:    timeout,
+		tlsEnabled: !opts.DisableTLS,
+		tlsConfig:  tlsConfig,
+		handshake:  handshake,
+		sem:        semaphore.NewWeighted(int64(dialers)),
+		logger:     logger,
+	}, nil
+}
+
+// Establishes connection to server. TLS handshake is completed before
+// return, so resumed sessions can be told apart.
+func (f *ConnFactory) Dial(ctx context.Context) (net.Conn, error) {
+	return f.DialNth(ctx, 0)
+}
+
+// Like Dial, but starts connection attempts with n-th address of server,
+// so parallel connections are spread across server addresses. Server
+// addresses of both families are tried concurrently with small delay,
+// starting with last address connected successfully. After series of
+// failures dials return ErrCircuitOpen for a while without connection
+// attempts.
+func (f *ConnFactory) DialNth(ctx context.Context, n uint) (net.Conn, error) {
+	ok, trial := f.breaker.allow()
+	if !ok {
+		return nil, ErrCircuitOpen
+	}
+	conn, err := f.dial(ctx, n)
+	switch {
+	case err == nil:
+		f.breaker.success()
+	case ctx.Err() != nil:
+		f.breaker.cancelled(trial)
+	default:
+		if f.breaker.failure(trial) {
+			f.logger.Warning("Server %s seems down: %v. Suspending connection attempts for %v",
+				f.addr, err, f.breaker.timeout)
+		}
+	}
+	return conn, err
+}
+
+func (f *ConnFactory) dial(ctx context.Context, n uint) (net.Conn, error) {
+	if err := f.sem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	defer f.sem.Release(1)
+	myctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	ips := f.ips
+	if ips == nil {
+		var err error
+		ips, err = f.resolver.LookupIP(myctx, f.host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f.lastGoodMu.Lock()
+	lastGood := f.lastGood
+	f.lastGoodMu.Unlock()
+	var reachable []net.IP
+	for _, ip := range ips {
+		if f.sockopts.Reachable(ip) {
+			reachable = append(reachable, ip)
+		}
+	}
+	conn, ip, err := dialRace(myctx, f.sockopts.Dialer("tcp"), sortAddrs(reachable, lastGood, n),
+		f.port, CONNECTION_ATTEMPT_DELAY)
+	if err != nil {
+		return nil, err
+	}
+	f.lastGoodMu.Lock()
+	f.lastGood = ip
+	f.lastGoodMu.Unlock()
+	f.logger.Debug("Connected to %s at %s", f.addr, conn.RemoteAddr())
+	if !f.tlsEnabled {
+		return conn, nil
+	}
+	type handshakeResult struct {
+		conn net.Conn
+		err  error
+	}
+	resc := make(chan handshakeResult, 1)
+	go func() {
+		tlsConn, err := f.handshake(conn, f.tlsConfig)
+		resc <- handshakeResult{tlsConn, err}
+	}()
+	var res handshakeResult
+	select {
+	case <-myctx.Done():
+		conn.Close()
+		<-resc
+		return nil, myctx.Err()
+	case res = <-resc:
+	}
+	if res.err != nil {
+		conn.Close()
+		return nil, res.err
+	}
+	if tlsConn, ok := res.conn.(*tls.Conn); ok {
+		f.logger.Info("TLS handshake with %s at %s completed, session resumed: %t",
+			f.addr, conn.RemoteAddr(), tlsConn.ConnectionState().DidResume)
+	}
+	return res.conn, nil
+}
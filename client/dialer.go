@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Lookup attempts made when server hostname is resolved once
+const RESOLVE_ATTEMPTS = 3
+
+// Delay before connection attempt to next server address while
+// previous attempt is still in progress, see RFC 8305 section 5
+const CONNECTION_ATTEMPT_DELAY = 250 * time.Millisecond
+
+// Orders addresses for connection attempts as RFC 8305 section 4
+// suggests: address families are interleaved, starting with family of
+// preferred address or IPv6. Preferred address goes first if present.
+// Result is then rotated by shift positions, so parallel connections
+// can start with different addresses.
+func sortAddrs(ips []net.IP, preferred net.IP, shift uint) []net.IP {
+	var v6, v4 []net.IP
+	preferV4 := false
+	for _, ip := range ips {
+		isV4 := ip.To4() != nil
+		if preferred != nil && ip.Equal(preferred) {
+			preferV4 = isV4
+			if isV4 {
+				v4 = append([]net.IP{ip}, v4...)
+			} else {
+				v6 = append([]net.IP{ip}, v6...)
+			}
+			continue
+		}
+		if isV4 {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	if preferV4 {
+		first, second = v4, v6
+	}
+	res := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+	if len(res) == 0 {
+		return res
+	}
+	k := int(shift % uint(len(res)))
+	return append(res[k:len(res):len(res)], res[:k]...)
+}
+
+// Dialer of TCP connections, satisfied by net.Dialer
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type dialResult struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+// Connects to addresses in given order. Next attempt starts when
+// previous one fails or after delay, whichever comes first. Returns
+// first established connection, other attempts are cancelled.
+func dialRace(ctx context.Context, dialer contextDialer, ips []net.IP, port int, delay time.Duration) (net.Conn, net.IP, error) {
+	if len(ips) == 0 {
+		return nil, nil, errors.New("no addresses to connect to")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult)
+	var (
+		next, pending int
+		attemptDelay  <-chan time.Time
+		firstErr      error
+	)
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		attemptDelay = nil
+		if next < len(ips) {
+			attemptDelay = time.After(delay)
+		}
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+			select {
+			case results <- dialResult{conn, ip, err}:
+			case <-ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+	start()
+	for pending > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-attemptDelay:
+			start()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, res.ip, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(ips) {
+				start()
+			}
+		}
+	}
+	return nil, nil, firstErr
+}
@@ -0,0 +1,282 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ipList(s string) []net.IP {
+	if s == "" {
+		return nil
+	}
+	var res []net.IP
+	for _, f := range strings.Split(s, ",") {
+		res = append(res, net.ParseIP(f))
+	}
+	return res
+}
+
+func TestSortAddrs(t *testing.T) {
+	cases := []struct {
+		name      string
+		ips       string
+		preferred string
+		shift     uint
+		want      string
+	}{
+		{"empty", "", "", 0, ""},
+		{"empty with shift", "", "", 3, ""},
+		{"ipv4 only", "192.0.2.1,192.0.2.2", "", 0, "192.0.2.1,192.0.2.2"},
+		{"ipv6 goes first", "192.0.2.1,192.0.2.2,2001:db8::1,2001:db8::2",
+			"", 0, "2001:db8::1,192.0.2.1,2001:db8::2,192.0.2.2"},
+		{"uneven families", "192.0.2.1,192.0.2.2,192.0.2.3,2001:db8::1",
+			"", 0, "2001:db8::1,192.0.2.1,192.0.2.2,192.0.2.3"},
+		{"preferred ipv4 goes first", "2001:db8::1,192.0.2.1,192.0.2.2",
+			"192.0.2.2", 0, "192.0.2.2,2001:db8::1,192.0.2.1"},
+		{"preferred ipv6 goes first", "2001:db8::1,2001:db8::2,192.0.2.1",
+			"2001:db8::2", 0, "2001:db8::2,192.0.2.1,2001:db8::1"},
+		{"preferred is gone", "192.0.2.1,2001:db8::1", "192.0.2.9", 0, "2001:db8::1,192.0.2.1"},
+		{"shift rotates", "192.0.2.1,192.0.2.2,192.0.2.3", "", 1, "192.0.2.2,192.0.2.3,192.0.2.1"},
+		{"shift wraps", "192.0.2.1,192.0.2.2,192.0.2.3", "", 4, "192.0.2.2,192.0.2.3,192.0.2.1"},
+		{"shift after preference", "192.0.2.1,192.0.2.2,2001:db8::1",
+			"192.0.2.2", 2, "192.0.2.1,192.0.2.2,2001:db8::1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ips := ipList(c.ips)
+			orig := append([]net.IP(nil), ips...)
+			got := sortAddrs(ips, net.ParseIP(c.preferred), c.shift)
+			var parts []string
+			for _, ip := range got {
+				parts = append(parts, ip.String())
+			}
+			if s := strings.Join(parts, ","); s != c.want {
+				t.Fatalf("got %s, want %s", s, c.want)
+			}
+			for i := range orig {
+				if !orig[i].Equal(ips[i]) {
+					t.Fatal("input slice modified")
+				}
+			}
+		})
+	}
+}
+
+// Behavior of fake dialer for address
+type fakeDial struct {
+	delay time.Duration
+	err   error
+	// Dial doesn't finish until cancelled
+	hang bool
+}
+
+type fakeDialer struct {
+	plan map[string]fakeDial
+	mux  sync.Mutex
+	// Addresses in order of dial start
+	started   []string
+	startedAt map[string]time.Time
+	cancelled map[string]bool
+	closed    map[string]bool
+}
+
+func newFakeDialer(plan map[string]fakeDial) *fakeDialer {
+	return &fakeDialer{
+		plan:      plan,
+		startedAt: make(map[string]time.Time),
+		cancelled: make(map[string]bool),
+		closed:    make(map[string]bool),
+	}
+}
+
+// Returns time from given moment till start of attempt to address
+func (d *fakeDialer) since(host string, t time.Time) time.Duration {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.startedAt[host].Sub(t)
+}
+
+type fakeConn struct {
+	net.Conn
+	d    *fakeDialer
+	host string
+}
+
+func (c *fakeConn) Close() error {
+	c.d.mux.Lock()
+	c.d.closed[c.host] = true
+	c.d.mux.Unlock()
+	return c.Conn.Close()
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(address)
+	d.mux.Lock()
+	d.started = append(d.started, host)
+	d.startedAt[host] = time.Now()
+	p := d.plan[host]
+	d.mux.Unlock()
+	var timer <-chan time.Time
+	if !p.hang {
+		timer = time.After(p.delay)
+	}
+	select {
+	case <-timer:
+	case <-ctx.Done():
+		d.mux.Lock()
+		d.cancelled[host] = true
+		d.mux.Unlock()
+		return nil, ctx.Err()
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	c, _ := net.Pipe()
+	return &fakeConn{c, d, host}, nil
+}
+
+func TestDialRace(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	errRefused := errors.New("connection refused")
+	cases := []struct {
+		name    string
+		ips     string
+		plan    map[string]fakeDial
+		want    string // winner, empty if error expected
+		wantErr error
+		// Addresses expected to be attempted, in order
+		started string
+		check   func(t *testing.T, d *fakeDialer, start time.Time)
+	}{
+		{
+			name:    "first wins",
+			ips:     "192.0.2.1,192.0.2.2",
+			plan:    map[string]fakeDial{},
+			want:    "192.0.2.1",
+			started: "192.0.2.1",
+		},
+		{
+			name: "stalled attempt is staggered and cancelled",
+			ips:  "192.0.2.1,192.0.2.2",
+			plan: map[string]fakeDial{
+				"192.0.2.1": {hang: true},
+			},
+			want:    "192.0.2.2",
+			started: "192.0.2.1,192.0.2.2",
+			check: func(t *testing.T, d *fakeDialer, start time.Time) {
+				if after := d.since("192.0.2.2", start); after < delay {
+					t.Errorf("second attempt started after %v, before attempt delay", after)
+				}
+				waitFor(t, d, func() bool { return d.cancelled["192.0.2.1"] }, "stalled attempt cancelled")
+			},
+		},
+		{
+			name: "failure starts next attempt at once",
+			ips:  "192.0.2.1,192.0.2.2",
+			plan: map[string]fakeDial{
+				"192.0.2.1": {err: errRefused},
+			},
+			want:    "192.0.2.2",
+			started: "192.0.2.1,192.0.2.2",
+			check: func(t *testing.T, d *fakeDialer, start time.Time) {
+				if after := d.since("192.0.2.2", start); after >= delay {
+					t.Errorf("second attempt started after %v, not right after failure", after)
+				}
+			},
+		},
+		{
+			name: "slow loser is closed",
+			ips:  "192.0.2.1,192.0.2.2",
+			plan: map[string]fakeDial{
+				"192.0.2.1": {delay: 3 * delay},
+				"192.0.2.2": {delay: delay / 2},
+			},
+			want:    "192.0.2.2",
+			started: "192.0.2.1,192.0.2.2",
+			check: func(t *testing.T, d *fakeDialer, start time.Time) {
+				waitFor(t, d, func() bool { return d.cancelled["192.0.2.1"] || d.closed["192.0.2.1"] },
+					"losing attempt cancelled or its connection closed")
+			},
+		},
+		{
+			name: "all fail",
+			ips:  "192.0.2.1,192.0.2.2,192.0.2.3",
+			plan: map[string]fakeDial{
+				"192.0.2.1": {err: errRefused},
+				"192.0.2.2": {err: errors.New("no route")},
+				"192.0.2.3": {err: errors.New("timeout")},
+			},
+			wantErr: errRefused,
+			started: "192.0.2.1,192.0.2.2,192.0.2.3",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := newFakeDialer(c.plan)
+			start := time.Now()
+			conn, ip, err := dialRace(context.Background(), d, ipList(c.ips), 443, delay)
+			if c.wantErr != nil {
+				if err != c.wantErr {
+					t.Fatalf("got error %v, want %v", err, c.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer conn.Close()
+				if ip.String() != c.want {
+					t.Fatalf("connected to %v, want %s", ip, c.want)
+				}
+				if fc := conn.(*fakeConn); fc.host != c.want {
+					t.Fatalf("got connection of %s for address %v", fc.host, ip)
+				}
+			}
+			d.mux.Lock()
+			started := strings.Join(d.started, ",")
+			d.mux.Unlock()
+			if started != c.started {
+				t.Fatalf("attempted %s, want %s", started, c.started)
+			}
+			if c.check != nil {
+				c.check(t, d, start)
+			}
+		})
+	}
+}
+
+// Waits for condition checked with dialer state locked
+func waitFor(t *testing.T, d *fakeDialer, cond func() bool, what string) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		d.mux.Lock()
+		ok := cond()
+		d.mux.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDialRaceContext(t *testing.T) {
+	d := newFakeDialer(map[string]fakeDial{
+		"192.0.2.1": {hang: true},
+		"192.0.2.2": {hang: true},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, _, err := dialRace(ctx, d, ipList("192.0.2.1,192.0.2.2"), 443, time.Hour); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	if _, _, err := dialRace(context.Background(), d, nil, 443, time.Hour); err == nil {
+		t.Fatal("dial without addresses succeeded")
+	}
+}
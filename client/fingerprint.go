@@ -0,0 +1,102 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/Snawoot/udpierce/proto"
+	"math/rand"
+	"time"
+)
+
+// ClientHello profiles. Profiles adjust parameters which crypto/tls
+// allows to control: sets of offered cipher suites and curves and ALPN.
+// crypto/tls orders suites and curves on its own, and extension order
+// and GREASE values of browsers can't be reproduced this way either,
+// use TLSHandshake option of ConnFactory to plug in TLS library which
+// can.
+const (
+	PROFILE_GO      = "go"
+	PROFILE_CHROME  = "chrome"
+	PROFILE_FIREFOX = "firefox"
+	// Random subsets of cipher suites and curves, chosen once per
+	// connection factory
+	PROFILE_RANDOM = "random"
+)
+
+// Browsers offer h2 too, but connection speaks HTTP/1.1 after handshake:
+// proxy or CDN choosing h2 would break it
+var browserALPN = []string{"http/1.1"}
+
+var chromeCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+}
+
+var firefoxCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// Returns handshake parameters of profile. Default "go" profile has
+// no parameters.
+func TLSProfile(name string) (*proto.TLSParams, error) {
+	switch name {
+	case "", PROFILE_GO:
+		return nil, nil
+	case PROFILE_CHROME:
+		return &proto.TLSParams{
+			ALPN:         browserALPN,
+			CipherSuites: chromeCipherSuites,
+			Curves:       []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		}, nil
+	case PROFILE_FIREFOX:
+		return &proto.TLSParams{
+			ALPN:         browserALPN,
+			CipherSuites: firefoxCipherSuites,
+			Curves:       []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521},
+		}, nil
+	case PROFILE_RANDOM:
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		// ECDHE AEAD suites and common curves are always offered, so
+		// handshake doesn't fail for lack of them
+		suites := append([]uint16(nil), firefoxCipherSuites[:4]...)
+		for _, suite := range firefoxCipherSuites[4:] {
+			if rng.Intn(2) == 0 {
+				suites = append(suites, suite)
+			}
+		}
+		curves := []tls.CurveID{tls.X25519, tls.CurveP256}
+		for _, curve := range []tls.CurveID{tls.CurveP384, tls.CurveP521} {
+			if rng.Intn(2) == 0 {
+				curves = append(curves, curve)
+			}
+		}
+		return &proto.TLSParams{
+			CipherSuites: suites,
+			Curves:       curves,
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown TLS profile %q", name)
+}
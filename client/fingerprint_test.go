@@ -0,0 +1,39 @@
+package client
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestRandomProfile(t *testing.T) {
+	known := make(map[uint16]bool)
+	for _, suite := range firefoxCipherSuites {
+		known[suite] = true
+	}
+	sets := make(map[int]bool)
+	for i := 0; i < 50; i++ {
+		params, err := TLSProfile(PROFILE_RANDOM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[uint16]bool)
+		for _, suite := range params.CipherSuites {
+			if !known[suite] || seen[suite] {
+				t.Fatalf("unknown or repeated suite %s", tls.CipherSuiteName(suite))
+			}
+			seen[suite] = true
+		}
+		for _, suite := range firefoxCipherSuites[:4] {
+			if !seen[suite] {
+				t.Fatalf("suite %s isn't offered", tls.CipherSuiteName(suite))
+			}
+		}
+		if len(params.Curves) < 2 || params.Curves[0] != tls.X25519 || params.Curves[1] != tls.CurveP256 {
+			t.Fatalf("got curves %v, want X25519 and P-256 offered", params.Curves)
+		}
+		sets[len(params.CipherSuites)*10+len(params.Curves)] = true
+	}
+	if len(sets) < 2 {
+		t.Fatal("profile offers the same sets each time")
+	}
+}
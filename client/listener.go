@@ -0,0 +1,336 @@
+package client
+
+import (
+	"context"
+	"github.com/Snawoot/udpierce/acl"
+	"github.com/Snawoot/udpierce/proto"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const DEFAULT_EXPIRE = 2 * time.Minute
+
+type sessionEntry struct {
+	sendexpire time.Time
+	recvexpire time.Time
+	sess       *Session
+	// Transparent socket sending replies on behalf of original
+	// destination, TPROXY mode only
+	reply *net.UDPConn
+}
+
+// Reads datagram with its sender and original destination. Destination
+// is nil for regular sockets.
+type dgramReadFunc func(b []byte) (n int, src, dst net.Addr, err error)
+
+type ListenerOptions struct {
+	// Listen address: UDP host:port or unix datagram socket path
+	Bind string
+	// Either "udp" (default), "unixgram" or "tproxy". Latter is UDP
+	// socket receiving datagrams redirected by TPROXY target of
+	// iptables (Linux only). Each pair of sender and original
+	// destination gets own session forwarded to that destination.
+	Network string
+	// Permissions of unix socket file. Zero leaves umask default.
+	SocketMode os.FileMode
+	// Destination requested from server for sessions, optional. Server
+	// has to allow dynamic destinations. Not used in TPROXY mode.
+	Destination string
+	// Idle session lifetime. Defaults to DEFAULT_EXPIRE.
+	Expire time.Duration
+	// Restricts senders allowed to start session, optional
+	ACL    *acl.ACL
+	Logger proto.Logger
+}
+
+// Listener accepts datagrams and forwards them over sessions, one
+// session for each sender address
+type Listener struct {
+	sessfact   *SessionFactory
+	acl        *acl.ACL
+	bind       string
+	network    string
+	socketMode os.FileMode
+	dest       string
+	expire     time.Duration
+	logger     proto.Logger
+	sessions   map[string]*sessionEntry
+	sessmux    sync.RWMutex
+	connevent  chan struct{}
+	conn       net.PacketConn
+}
+
+func NewListener(sessfact *SessionFactory, opts ListenerOptions) *Listener {
+	expire := opts.Expire
+	if expire <= 0 {
+		expire = DEFAULT_EXPIRE
+	}
+	network := opts.Network
+	if network == "" {
+		network = "udp"
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = proto.NopLogger{}
+	}
+	return &Listener{
+		sessfact:   sessfact,
+		acl:        opts.ACL,
+		bind:       opts.Bind,
+		network:    network,
+		socketMode: opts.SocketMode,
+		dest:       opts.Destination,
+		expire:     expire,
+		logger:     logger,
+		sessions:   make(map[string]*sessionEntry),
+		connevent:  make(chan struct{}, 1),
+	}
+}
+
+func (l *Listener) notify_conn() {
+	select {
+	case l.connevent <- struct{}{}:
+	default:
+	}
+}
+
+func sessionKey(src, dst net.Addr) string {
+	if dst == nil {
+		return src.String()
+	}
+	return src.String() + "->" + dst.String()
+}
+
+func (l *Listener) new_session(ctx context.Context, src, dst net.Addr) (*sessionEntry, error) {
+	entry := &sessionEntry{
+		recvexpire: time.Now().Add(l.expire),
+	}
+	if dst == nil {
+		cb := func(data []byte) (int, error) {
+			entry.sendexpire = time.Now().Add(l.expire)
+			return l.conn.WriteTo(data, src)
+		}
+		if l.dest != "" {
+			l.logger.Info("Creating new session for %s -> %s", src.String(), l.dest)
+			entry.sess = l.sessfact.SessionTo(ctx, l.dest, cb)
+		} else {
+			l.logger.Info("Creating new session for %s", src.String())
+			entry.sess = l.sessfact.Session(ctx, cb)
+		}
+	} else {
+		l.logger.Info("Creating new session for %s -> %s", src.String(), dst.String())
+		reply, err := dialTransparent(dst.(*net.UDPAddr), src.(*net.UDPAddr))
+		if err != nil {
+			return nil, err
+		}
+		cb := func(data []byte) (int, error) {
+			entry.sendexpire = time.Now().Add(l.expire)
+			return reply.Write(data)
+		}
+		entry.reply = reply
+		entry.sess = l.sessfact.SessionTo(ctx, dst.String(), cb)
+		go l.serveReplySocket(entry)
+	}
+	l.sessmux.Lock()
+	l.sessions[sessionKey(src, dst)] = entry
+	l.sessmux.Unlock()
+	l.notify_conn()
+	return entry, nil
+}
+
+// Socket bound to original destination and connected to client takes
+// precedence over listening socket for datagrams of that client which are
+// not diverted by TPROXY, so they are read from it as well
+func (l *Listener) serveReplySocket(entry *sessionEntry) {
+	buf := make([]byte, proto.DGRAM_BUF)
+	for {
+		n, err := entry.reply.Read(buf)
+		if err != nil {
+			return
+		}
+		entry.recvexpire = time.Now().Add(l.expire)
+		entry.sess.Write(buf[:n])
+	}
+}
+
+// Reply socket goes first, so its reader doesn't feed stopped session
+func (e *sessionEntry) stop() {
+	if e.reply != nil {
+		e.reply.Close()
+	}
+	e.sess.Stop()
+}
+
+func (l *Listener) track_expire(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-l.connevent:
+		}
+		for {
+			now := time.Now()
+			inf := now.Add(2 * l.expire) // pseudo-"infinity" for min search
+			closest_expire := inf
+			expired_keys := make([]string, 0)
+			expired_entries := make([]*sessionEntry, 0)
+			l.sessmux.RLock()
+			// Determine next closest expiration and expired sessions
+			for k, v := range l.sessions {
+				// exp = max(sendexpire, recvexpire)
+				exp := v.recvexpire
+				if v.sendexpire.After(exp) {
+					exp = v.sendexpire
+				}
+				if now.After(exp) {
+					// Session expired
+					expired_keys = append(expired_keys, k)
+					expired_entries = append(expired_entries, v)
+				} else {
+					// Set next wakeup time as min(session expires)
+					if exp.Before(closest_expire) {
+						closest_expire = exp
+					}
+				}
+			}
+			l.sessmux.RUnlock()
+
+			// Clear expired
+			if len(expired_keys) > 0 {
+				l.sessmux.Lock()
+				for _, k := range expired_keys {
+					l.logger.Info("Session for %s expired", k)
+					delete(l.sessions, k)
+				}
+				l.sessmux.Unlock()
+				for _, e := range expired_entries {
+					e.stop()
+				}
+			}
+
+			// Wait till next expired session
+			if closest_expire == inf {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(closest_expire)):
+			}
+		}
+	}
+}
+
+// Serves datagrams until context is done. All sessions are stopped
+// on return.
+func (l *Listener) ListenAndServe(ctx context.Context) error {
+	l.logger.Info("Listening on %s %s", l.network, l.bind)
+	if l.network == "tproxy" {
+		conn, err := listenTProxy(l.bind)
+		if err != nil {
+			return err
+		}
+		l.conn = conn
+		oob := make([]byte, 128)
+		return l.serve(ctx, conn, func(b []byte) (int, net.Addr, net.Addr, error) {
+			return readFromOrigDst(conn, b, oob)
+		})
+	}
+	if l.network == "unixgram" {
+		if err := proto.RemoveStaleSocket(l.network, l.bind); err != nil {
+			return err
+		}
+	}
+	conn, err := net.ListenPacket(l.network, l.bind)
+	if err != nil {
+		return err
+	}
+	if l.network == "unixgram" {
+		defer os.Remove(l.bind)
+		if err := proto.ChmodSocket(l.bind, l.socketMode); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	return l.Serve(ctx, conn)
+}
+
+// Serves datagrams arriving to conn until context is done
+func (l *Listener) Serve(ctx context.Context, conn net.PacketConn) error {
+	l.conn = conn
+	return l.serve(ctx, conn, func(b []byte) (int, net.Addr, net.Addr, error) {
+		n, addr, err := conn.ReadFrom(b)
+		return n, addr, nil, err
+	})
+}
+
+func (l *Listener) serve(ctx context.Context, conn io.Closer, read dgramReadFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer l.closeReplySockets()
+	go l.track_expire(ctx)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, proto.DGRAM_BUF)
+	for {
+		n, src, dst, err := read(buf)
+		if n > 0 && !replyable(src) {
+			l.logger.Debug("Dropped datagram from unbound socket: replies can't be delivered")
+		} else if n > 0 {
+			l.dispatch(ctx, src, dst, buf[:n])
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			l.logger.Error("Datagram receive error: %v", err)
+		}
+	}
+}
+
+func (l *Listener) dispatch(ctx context.Context, src, dst net.Addr, data []byte) {
+	l.sessmux.RLock()
+	entry, ok := l.sessions[sessionKey(src, dst)]
+	l.sessmux.RUnlock()
+	if !ok {
+		if !l.acl.AllowedAddr(src) {
+			l.logger.Debug("Dropped datagram from %s: denied by ACL", src.String())
+			return
+		}
+		var err error
+		entry, err = l.new_session(ctx, src, dst)
+		if err != nil {
+			l.logger.Error("Can't create session for %s: %v", src.String(), err)
+			return
+		}
+	}
+	entry.recvexpire = time.Now().Add(l.expire)
+	entry.sess.Write(data)
+}
+
+func (l *Listener) closeReplySockets() {
+	l.sessmux.RLock()
+	defer l.sessmux.RUnlock()
+	for _, e := range l.sessions {
+		if e.reply != nil {
+			e.reply.Close()
+		}
+	}
+}
+
+// Unix datagram sockets of senders have to be bound to some path,
+// otherwise there is no address to send replies to
+func replyable(addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	if uaddr, ok := addr.(*net.UnixAddr); ok {
+		return uaddr.Name != ""
+	}
+	return true
+}
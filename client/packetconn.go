@@ -0,0 +1,187 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DialConfig combines options for standalone session
+type DialConfig struct {
+	ConnFactory ConnFactoryOptions
+	Session     SessionOptions
+}
+
+var errClosed = errors.New("use of closed udpierce connection")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Addr is an address of udpierce session endpoint
+type Addr struct {
+	addr string
+}
+
+func (a *Addr) Network() string { return "udpierce" }
+func (a *Addr) String() string  { return a.addr }
+
+// PacketConn is a net.PacketConn backed by session. Destination address
+// of written datagrams is ignored: all of them are delivered to server
+// endpoint. Received datagrams are reported as coming from server address.
+type PacketConn struct {
+	sess       *Session
+	localAddr  *Addr
+	remoteAddr *Addr
+	recvq      chan []byte
+	closed     chan struct{}
+	closeOnce  sync.Once
+	mux        sync.RWMutex
+	rdeadline  time.Time
+	wdeadline  time.Time
+	rdchanged  chan struct{}
+}
+
+// Starts new session and returns PacketConn for it. Connections to server
+// are established in background. Session is stopped on Close or when
+// context is done.
+func Dial(ctx context.Context, cfg DialConfig) (*PacketConn, error) {
+	connfactory, err := NewConnFactory(cfg.ConnFactory)
+	if err != nil {
+		return nil, err
+	}
+	return NewPacketConn(ctx, NewSessionFactory(connfactory, cfg.Session)), nil
+}
+
+// Returns PacketConn backed by new session of factory
+func NewPacketConn(ctx context.Context, sessfact *SessionFactory) *PacketConn {
+	c := &PacketConn{
+		remoteAddr: &Addr{sessfact.connfactory.addr},
+		recvq:      make(chan []byte, MAX_DGRAM_QLEN),
+		closed:     make(chan struct{}),
+		rdchanged:  make(chan struct{}),
+	}
+	c.sess = sessfact.Session(ctx, c.enqueue)
+	c.localAddr = &Addr{c.sess.ID()}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.closed:
+		}
+	}()
+	return c
+}
+
+func (c *PacketConn) enqueue(data []byte) (int, error) {
+	dgram := make([]byte, len(data))
+	copy(dgram, data)
+	select {
+	case c.recvq <- dgram:
+	default:
+		c.sess.logger.Warning("Session %s: dropped packet due to receive queue overflow", c.sess.id)
+	}
+	return len(data), nil
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mux.RLock()
+		deadline, changed := c.rdeadline, c.rdchanged
+		c.mux.RUnlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, timeoutError{}
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		n, err := 0, error(nil)
+		done := true
+		select {
+		case dgram := <-c.recvq:
+			n = copy(b, dgram)
+		case <-c.closed:
+			err = errClosed
+		case <-timeout:
+			err = timeoutError{}
+		case <-changed:
+			done = false
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !done {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return n, c.remoteAddr, nil
+	}
+}
+
+func (c *PacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	select {
+	case <-c.closed:
+		return 0, errClosed
+	default:
+	}
+	if !c.wdeadline.IsZero() && time.Now().After(c.wdeadline) {
+		return 0, timeoutError{}
+	}
+	c.sess.Write(b)
+	return len(b), nil
+}
+
+func (c *PacketConn) Close() error {
+	err := errClosed
+	c.closeOnce.Do(func() {
+		c.mux.Lock()
+		close(c.closed)
+		c.sess.Stop()
+		c.mux.Unlock()
+		err = nil
+	})
+	return err
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// Returns address of udpierce server
+func (c *PacketConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.mux.Lock()
+	c.rdeadline = t
+	// Wake up blocked readers to pick up new deadline
+	close(c.rdchanged)
+	c.rdchanged = make(chan struct{})
+	c.mux.Unlock()
+	return nil
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	c.mux.Lock()
+	c.wdeadline = t
+	c.mux.Unlock()
+	return nil
+}
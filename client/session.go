@@ -0,0 +1,328 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"encoding/hex"
+	"github.com/Snawoot/udpierce/proto"
+	"github.com/google/uuid"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const MAX_DGRAM_QLEN = 128
+const DEFAULT_BACKOFF = 5 * time.Second
+const DEFAULT_CONNS = 4
+
+type SessionOptions struct {
+	// Connection request template. Defaults to plain CONNECT request.
+	Request *proto.RequestTemplate
+	// Password authentication. Nil means no password is sent.
+	Auth *proto.ClientAuth
+	// End-to-end frame encryption, optional
+	Crypter *proto.FrameCrypter
+	// Frame padding, optional
+	Padding *proto.Padding
+	// Initial interval between failed connection attempts. Doubled with
+	// each consecutive failure and randomized. Defaults to DEFAULT_BACKOFF.
+	Backoff time.Duration
+	// Limit of interval between failed connection attempts. Defaults to
+	// DEFAULT_MAX_BACKOFF.
+	MaxBackoff time.Duration
+	// Amount of parallel connections. Defaults to DEFAULT_CONNS.
+	Conns uint
+	// Destination requested from server, optional. Server has to
+	// allow dynamic destinations.
+	Destination string
+	// Called with headers of each server hello, optional. Called
+	// concurrently from all connections of session.
+	OnHello HelloCallback
+	Logger  proto.Logger
+}
+
+func (o SessionOptions) withDefaults() SessionOptions {
+	if o.Request == nil {
+		o.Request = proto.DefaultRequestTemplate()
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = DEFAULT_BACKOFF
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	if o.MaxBackoff < o.Backoff {
+		o.MaxBackoff = o.Backoff
+	}
+	if o.Conns == 0 {
+		o.Conns = DEFAULT_CONNS
+	}
+	if o.Logger == nil {
+		o.Logger = proto.NopLogger{}
+	}
+	return o
+}
+
+type SessionFactory struct {
+	opts        SessionOptions
+	connfactory *ConnFactory
+}
+
+type ReplyCallback func([]byte) (int, error)
+
+type HelloCallback func(sess_id string, header http.Header)
+
+func NewSessionFactory(connfactory *ConnFactory, opts SessionOptions) *SessionFactory {
+	return &SessionFactory{
+		opts:        opts.withDefaults(),
+		connfactory: connfactory,
+	}
+}
+
+// Starts new session. Session is stopped when context is done or
+// Stop is called.
+func (f *SessionFactory) Session(ctx context.Context, reply_cb ReplyCallback) *Session {
+	return NewSession(ctx, f.connfactory, f.opts, reply_cb)
+}
+
+// Starts new session forwarded to given destination instead of
+// default destination of server
+func (f *SessionFactory) SessionTo(ctx context.Context, dst string, reply_cb ReplyCallback) *Session {
+	opts := f.opts
+	opts.Destination = dst
+	return NewSession(ctx, f.connfactory, opts, reply_cb)
+}
+
+type Session struct {
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	connfactory *ConnFactory
+	logger      proto.Logger
+	reply_cb    ReplyCallback
+	send_queue  chan []byte
+	ctx         context.Context
+	cancel      context.CancelFunc
+	reqTemplate *proto.RequestTemplate
+	auth        *proto.ClientAuth
+	crypter     *proto.FrameCrypter
+	padding     *proto.Padding
+	onHello     HelloCallback
+	header      http.Header
+	id          string
+}
+
+func NewSession(ctx context.Context, connfactory *ConnFactory, opts SessionOptions,
+	reply_cb ReplyCallback) *Session {
+	opts = opts.withDefaults()
+	u := uuid.New()
+	id := hex.EncodeToString(u[:])
+	ch := make(chan []byte, MAX_DGRAM_QLEN)
+	ctx, cancel := context.WithCancel(ctx)
+	var header http.Header
+	if opts.Destination != "" {
+		header = http.Header{opts.Request.Prefix() + proto.HDR_DEST: []string{opts.Destination}}
+	}
+	sess := Session{
+		backoff:     opts.Backoff,
+		maxBackoff:  opts.MaxBackoff,
+		connfactory: connfactory,
+		reply_cb:    reply_cb,
+		send_queue:  ch,
+		ctx:         ctx,
+		cancel:      cancel,
+		reqTemplate: opts.Request,
+		auth:        opts.Auth,
+		crypter:     opts.Crypter,
+		padding:     opts.Padding,
+		onHello:     opts.OnHello,
+		header:      header,
+		logger:      opts.Logger,
+		id:          id,
+	}
+	for i := uint(0); i < opts.Conns; i++ {
+		go sess.pump(i)
+	}
+	return &sess
+}
+
+// Session ID sent to server
+func (s *Session) ID() string {
+	return s.id
+}
+
+func (s *Session) do_backoff(err error, bo *backoff) {
+	if s.Stopped() {
+		return
+	}
+	delay := bo.next()
+	s.logger.Info("Upstream connection terminated with reason: %v. Backoff for %v...",
+		err, delay.Round(time.Millisecond))
+	select {
+	case <-time.After(delay):
+	case <-s.ctx.Done():
+	}
+}
+
+// Stops session. Datagrams written after that are discarded.
+func (s *Session) Stop() {
+	s.cancel()
+}
+
+func (s *Session) Stopped() bool {
+	select {
+	case <-s.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) Write(data []byte) {
+	if s.Stopped() {
+		return
+	}
+	dgram := make([]byte, len(data))
+	copy(dgram, data)
+	select {
+	case s.send_queue <- dgram:
+	default:
+		s.logger.Warning("Session %s: dropped packet due to send queue overflow", s.id)
+	}
+	return
+}
+
+// Maintains n-th connection of session
+func (s *Session) pump(n uint) {
+	bo := backoff{base: s.backoff, max: s.maxBackoff}
+	for {
+		if s.Stopped() {
+			return
+		}
+		conn, err := s.connfactory.DialNth(s.ctx, n)
+		if err != nil {
+			if s.Stopped() {
+				return
+			}
+			s.do_backoff(err, &bo)
+			continue
+		}
+
+		// Server hello may be followed by data, so
+		// further reads go through the same buffer
+		br := bufio.NewReader(conn)
+		conn = &bufferedConn{conn, br}
+
+		var sendAEAD, recvAEAD cipher.AEAD
+		prologue_done := make(chan struct{}, 1)
+		go func() {
+			defer func() {
+				prologue_done <- struct{}{}
+			}()
+			var prologue []byte
+			// Authentication tokens may differ from connection to connection
+			prologue, err = s.reqTemplate.Build(s.id, s.auth, s.header)
+			if err != nil {
+				return
+			}
+			_, err = conn.Write(prologue)
+			if err != nil {
+				return
+			}
+			var header http.Header
+			header, err = proto.ReadHello(br)
+			if err != nil {
+				return
+			}
+			if s.onHello != nil {
+				s.onHello(s.id, header)
+			}
+			if s.crypter != nil {
+				sendAEAD, recvAEAD, err = s.crypter.ClientHandshake(conn)
+			}
+		}()
+		select {
+		case <-s.ctx.Done():
+			conn.Close()
+			return
+		case <-prologue_done:
+		}
+
+		if err != nil {
+			conn.Close()
+			s.do_backoff(err, &bo)
+			continue
+		}
+
+		// Here goes actual data transfer in both directions
+		started := time.Now()
+		var wg sync.WaitGroup
+		wg.Add(2)
+		ctx, cancel := context.WithCancel(context.Background())
+		outputs := make(chan error, 2)
+		go func() {
+			var err error
+			defer func() {
+				wg.Done()
+				outputs <- err
+			}()
+			fw := proto.NewFrameWriter(conn, sendAEAD, s.padding)
+			fw.StartCover()
+			defer fw.StopCover()
+			for {
+				select {
+				case data := <-s.send_queue:
+					err = fw.WriteFrame(data)
+					if err == proto.ErrFrameTooLarge {
+						s.logger.Warning("Session %s: dropped packet of %d bytes: too large", s.id, len(data))
+						continue
+					}
+					if err != nil {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		go func() {
+			var err error
+			defer func() {
+				wg.Done()
+				outputs <- err
+			}()
+			fr := proto.NewFrameReader(conn, recvAEAD, s.padding)
+			for {
+				data, err := fr.ReadFrame()
+				if err != nil {
+					s.logger.Debug("Frame read from channel failed: %v", err)
+					return
+				}
+				n, err := s.reply_cb(data)
+				if err != nil || n != len(data) {
+					s.logger.Debug("Bad dgram send: %v", err)
+					return
+				}
+			}
+		}()
+		select {
+		case <-s.ctx.Done():
+			cancel()
+			conn.Close()
+			wg.Wait()
+			return
+		case err := <-outputs:
+			cancel()
+			conn.Close()
+			wg.Wait()
+			if time.Since(started) >= STABLE_CONN_TIME {
+				// Long-lived connection failure doesn't tell much
+				// about server availability
+				bo.reset()
+				s.logger.Info("Upstream connection terminated with reason: %v. Reconnecting...", err)
+				continue
+			}
+			s.do_backoff(err, &bo)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestSessionWriteAfterStop(t *testing.T) {
+	// Cancelled context keeps pumps from dialing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sess := NewSession(ctx, nil, SessionOptions{}, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2*MAX_DGRAM_QLEN; j++ {
+				sess.Write([]byte("late datagram"))
+			}
+		}()
+	}
+	sess.Stop()
+	sess.Stop()
+	wg.Wait()
+	if n := len(sess.send_queue); n != 0 {
+		t.Fatalf("%d datagrams queued after stop", n)
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Amount of TLS sessions kept for resumption
+const TLS_SESSION_CACHE_SIZE = 64
+
+// Parses SHA-256 hash of certificate SubjectPublicKeyInfo, encoded
+// either in base64 (as in HPKP pin-sha256) or in hex
+func ParsePinSHA256(s string) ([]byte, error) {
+	if pin, err := base64.StdEncoding.DecodeString(s); err == nil && len(pin) == sha256.Size {
+		return pin, nil
+	}
+	if pin, err := hex.DecodeString(s); err == nil && len(pin) == sha256.Size {
+		return pin, nil
+	}
+	return nil, fmt.Errorf("Bad pin %q: expected base64 or hex encoded SHA-256 hash", s)
+}
+
+func matchPin(cert *x509.Certificate, pins [][]byte) bool {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(hash[:], pin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if any certificate of verified chains matches pins
+func checkPins(chains [][]*x509.Certificate, pins [][]byte) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if matchPin(cert, pins) {
+				return nil
+			}
+		}
+	}
+	return errors.New("tls: no certificate of server chain matches pinned public keys")
+}
+
+// Builds client TLS config. If pins are given, server chain has to
+// contain certificate with one of pinned public keys. Pins without CA
+// file and hostname check are verified alone against server
+// certificate, allowing to use self-signed one.
+func makeClientTLSConfig(servername, certfile, keyfile, cafile string,
+	hostname_check bool, pins [][]byte) (*tls.Config, error) {
+	if !hostname_check && cafile == "" && len(pins) == 0 {
+		return nil, errors.New("Hostname check should not be disabled in absence of custom CA file or pins")
+	}
+	if certfile != "" && keyfile == "" || certfile == "" && keyfile != "" {
+		return nil, errors.New("Certificate file and key file must be specified only together")
+	}
+	var certs []tls.Certificate
+	if certfile != "" && keyfile != "" {
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	var roots *x509.CertPool
+	if cafile != "" {
+		roots = x509.NewCertPool()
+		certs, err := ioutil.ReadFile(cafile)
+		if err != nil {
+			return nil, err
+		}
+		if ok := roots.AppendCertsFromPEM(certs); !ok {
+			return nil, errors.New("Failed to load CA certificates")
+		}
+	}
+	tlsConfig := tls.Config{
+		RootCAs:      roots,
+		ServerName:   servername,
+		Certificates: certs,
+		// Reconnects resume previous sessions instead of full handshake
+		ClientSessionCache: tls.NewLRUClientSessionCache(TLS_SESSION_CACHE_SIZE),
+	}
+	if !hostname_check && cafile == "" {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(certificates [][]byte, _ [][]*x509.Certificate) error {
+			if len(certificates) == 0 {
+				return errors.New("tls: server presented no certificates")
+			}
+			cert, err := x509.ParseCertificate(certificates[0])
+			if err != nil {
+				return errors.New("tls: failed to parse certificate from server: " + err.Error())
+			}
+			// Only leaf certificate key is proven by handshake
+			return checkPins([][]*x509.Certificate{{cert}}, pins)
+		}
+	} else if !hostname_check {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(certificates [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(certificates))
+			for i, asn1Data := range certificates {
+				cert, err := x509.ParseCertificate(asn1Data)
+				if err != nil {
+					return errors.New("tls: failed to parse certificate from server: " + err.Error())
+				}
+				certs[i] = cert
+			}
+
+			opts := x509.VerifyOptions{
+				Roots:         roots, // On the server side, use config.ClientCAs.
+				DNSName:       "",    // No hostname check
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			chains, err := certs[0].Verify(opts)
+			if err != nil {
+				return err
+			}
+			if len(pins) > 0 {
+				return checkPins(chains, pins)
+			}
+			return nil
+		}
+	} else if len(pins) > 0 {
+		tlsConfig.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			return checkPins(chains, pins)
+		}
+	}
+	return &tlsConfig, nil
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Not defined by syscall package
+const (
+	ipv6RecvOrigDstAddr = 0x4a
+	ipv6Transparent     = 0x4b
+)
+
+func transparentControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = setTransparent(int(fd), network, recvOrigDst)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+func setTransparent(fd int, network string, recvOrigDst bool) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+	if network == "udp6" {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1); err != nil {
+			return err
+		}
+		if recvOrigDst {
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1); err != nil {
+				return err
+			}
+		}
+		// Dual-stack socket also receives IPv4 datagrams
+		syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		if recvOrigDst {
+			syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+		}
+		return nil
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+		return err
+	}
+	if recvOrigDst {
+		return syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+	}
+	return nil
+}
+
+// Opens UDP socket for datagrams diverted by TPROXY. Requires
+// CAP_NET_ADMIN.
+func listenTProxy(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// Opens UDP socket bound to foreign address, so datagrams can be sent
+// on behalf of original destination. Socket is connected to client, so
+// kernel doesn't deliver to it datagrams of other peers sent to the
+// same destination.
+func dialTransparent(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	if laddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	dialer := net.Dialer{
+		LocalAddr: laddr,
+		Control:   transparentControl(false),
+	}
+	conn, err := dialer.Dial(network, raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func readFromOrigDst(conn *net.UDPConn, b, oob []byte) (int, net.Addr, net.Addr, error) {
+	n, oobn, _, src, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return n, nil, nil, err
+	}
+	dst, err := parseOrigDst(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return n, src, dst, nil
+}
+
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_RECVORIGDSTADDR:
+			if len(m.Data) < 8 {
+				continue
+			}
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[4:8]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == ipv6RecvOrigDstAddr:
+			if len(m.Data) < 24 {
+				continue
+			}
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, errors.New("No original destination address in datagram")
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+var errTProxyUnsupported = errors.New("TPROXY is supported only on Linux")
+
+func listenTProxy(address string) (*net.UDPConn, error) {
+	return nil, errTProxyUnsupported
+}
+
+func dialTransparent(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTProxyUnsupported
+}
+
+func readFromOrigDst(conn *net.UDPConn, b, oob []byte) (int, net.Addr, net.Addr, error) {
+	return 0, nil, nil, errTProxyUnsupported
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"github.com/Snawoot/udpierce/proto"
+	"github.com/Snawoot/udpierce/tun"
+	"net"
+	"net/http"
+	"sync"
+)
+
+type TunnelOptions struct {
+	// Interface name. Empty name lets kernel pick one.
+	Name string
+	// Interface MTU. Zero leaves it intact.
+	MTU int
+	// Interface address, optional. Address assigned by server takes
+	// precedence.
+	Address *net.IPNet
+	// Networks routed through interface
+	Routes []*net.IPNet
+	Logger proto.Logger
+}
+
+// Tunnel forwards IP packets between TUN interface and single session
+type Tunnel struct {
+	sessfact *SessionFactory
+	opts     TunnelOptions
+	logger   proto.Logger
+	dev      *tun.Device
+	addr     *net.IPNet
+	addrmux  sync.Mutex
+}
+
+func NewTunnel(sessfact *SessionFactory, opts TunnelOptions) *Tunnel {
+	logger := opts.Logger
+	if logger == nil {
+		logger = proto.NopLogger{}
+	}
+	return &Tunnel{
+		sessfact: sessfact,
+		opts:     opts,
+		logger:   logger,
+	}
+}
+
+// Creates interface and forwards packets until context is done.
+// Interface is removed on return.
+func (t *Tunnel) Run(ctx context.Context) error {
+	dev, err := tun.Open(t.opts.Name)
+	if err != nil {
+		return err
+	}
+	t.dev = dev
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		dev.Close()
+	}()
+	if err = dev.Up(t.opts.MTU); err != nil {
+		return err
+	}
+	t.logger.Info("Using TUN interface %s", dev.Name())
+	if t.opts.Address != nil {
+		if err = t.setAddress(t.opts.Address); err != nil {
+			return err
+		}
+	}
+	for _, route := range t.opts.Routes {
+		if err = dev.AddRoute(route); err != nil {
+			return err
+		}
+	}
+
+	sessopts := t.sessfact.opts
+	sessopts.OnHello = t.onHello
+	sess := NewSession(ctx, t.sessfact.connfactory, sessopts, dev.Write)
+	defer sess.Stop()
+	buf := make([]byte, proto.DGRAM_BUF)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		sess.Write(buf[:n])
+	}
+}
+
+func (t *Tunnel) onHello(sess_id string, header http.Header) {
+	value := header.Get(t.sessfact.opts.Request.Prefix() + proto.HDR_ADDRESS)
+	if value == "" {
+		return
+	}
+	ip, network, err := net.ParseCIDR(value)
+	if err != nil {
+		t.logger.Error("Bad address %q assigned by server: %v", value, err)
+		return
+	}
+	if err = t.setAddress(&net.IPNet{IP: ip, Mask: network.Mask}); err != nil {
+		t.logger.Error("Can't assign address %s: %v", value, err)
+	}
+}
+
+// Replaces address of interface
+func (t *Tunnel) setAddress(addr *net.IPNet) error {
+	t.addrmux.Lock()
+	defer t.addrmux.Unlock()
+	if t.addr != nil && t.addr.String() == addr.String() {
+		return nil
+	}
+	if t.addr != nil {
+		if err := t.dev.DelAddress(t.addr); err != nil {
+			t.logger.Warning("Can't remove old address %s: %v", t.addr, err)
+		}
+	}
+	if err := t.dev.AddAddress(addr); err != nil {
+		return err
+	}
+	t.logger.Info("Interface %s address is %s", t.dev.Name(), addr)
+	t.addr = addr
+	return nil
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"github.com/Snawoot/udpierce/acl"
+	"github.com/Snawoot/udpierce/client"
+	"github.com/Snawoot/udpierce/proto"
+	"golang.org/x/sync/errgroup"
 	"log"
+	"net"
 	"os"
 )
 
@@ -18,24 +23,135 @@ func client_main(args *CLIArgs) int {
 	listenerLogger := NewCondLogger(log.New(logWriter, "LISTENER : ",
 		log.LstdFlags|log.Lshortfile),
 		args.verbosity)
+	aclLogger := NewCondLogger(log.New(logWriter, "ACL      : ",
+		log.LstdFlags|log.Lshortfile),
+		args.verbosity)
+	dialerLogger := NewCondLogger(log.New(logWriter, "DIALER   : ",
+		log.LstdFlags|log.Lshortfile),
+		args.verbosity)
+	dnsLogger := NewCondLogger(log.New(logWriter, "DNS      : ",
+		log.LstdFlags|log.Lshortfile),
+		args.verbosity)
 	mainLogger.Info("Starting client...")
-	connFactory, err := NewConnFactory(args.dst, args.timeout, args.tls,
-		args.cert, args.key, args.cafile,
-		args.hostname_check, args.tls_servername,
-		args.dialers, args.resolve_once)
+	ctx, cancel := signalContext()
+	defer cancel()
+	peerACL, err := acl.New(args.allowList, args.denyList, aclLogger)
+	if err != nil {
+		mainLogger.Critical("ACL construction failed: %v", err)
+		return 3
+	}
+	go peerACL.Watch(ctx, args.aclReload)
+	res, err := makeResolver(args, dnsLogger)
+	if err != nil {
+		mainLogger.Critical("Resolver construction failed: %v", err)
+		return 3
+	}
+	connFactory, err := client.NewConnFactory(client.ConnFactoryOptions{
+		Address:           args.dst,
+		Timeout:           args.timeout,
+		DisableTLS:        !args.tls,
+		CertFile:          args.cert,
+		KeyFile:           args.key,
+		CAFile:            args.cafile,
+		SkipHostnameCheck: !args.hostname_check,
+		PinSHA256:         args.pins,
+		TLSServerName:     args.tls_servername,
+		Dialers:           args.dialers,
+		ResolveOnce:       args.resolve_once,
+		Resolver:          res,
+		SocketOptions:     args.sockopts,
+		BreakerThreshold:  args.breakerThreshold,
+		BreakerTimeout:    args.breakerTimeout,
+		TLSProfile:        args.tlsProfile,
+		TLSParams:         args.tlsParams,
+		Logger:            dialerLogger,
+	})
 	if err != nil {
 		mainLogger.Critical("Connection factory construction failed: %v", err)
 		return 3
 	}
-	sessFactory := NewClientSessionFactory(args.password,
-		args.backoff,
-		args.conns,
-		connFactory,
-		sessLogger)
-	listener := NewClientListener(args.bind, args.expire, sessFactory, listenerLogger)
-	err = listener.ListenAndServe()
+	auth, err := proto.NewClientAuth(args.authScheme, args.username, args.password)
+	if err != nil {
+		mainLogger.Critical("Authentication setup failed: %v", err)
+		return 3
+	}
+	var crypter *proto.FrameCrypter
+	if args.psk != "" {
+		crypter = proto.NewFrameCrypter(args.psk)
+	}
+	padding, err := proto.NewPadding(args.padMode, args.padSize, args.coverInterval)
 	if err != nil {
+		mainLogger.Critical("Padding setup failed: %v", err)
+		return 3
+	}
+	httpHost := args.httpHost
+	if httpHost == "" && args.httpMethod != proto.DEFAULT_METHOD {
+		httpHost, _, err = net.SplitHostPort(args.dst)
+		if err != nil {
+			mainLogger.Critical("Bad destination address: %v", err)
+			return 3
+		}
+		if args.tls_servername != "" {
+			httpHost = args.tls_servername
+		}
+	}
+	sessFactory := client.NewSessionFactory(connFactory, client.SessionOptions{
+		Request: proto.NewRequestTemplate(args.httpMethod, args.httpPath, httpHost,
+			args.headerPrefix, args.httpHeaders.Header()),
+		Auth:       auth,
+		Crypter:    crypter,
+		Padding:    padding,
+		Backoff:    args.backoff,
+		MaxBackoff: args.maxBackoff,
+		Conns:      args.conns,
+		Logger:     sessLogger,
+	})
+	forwards := args.forwards
+	if len(forwards) == 0 {
+		forwards = ForwardList{{Bind: args.bind}}
+	}
+	// All listeners are stopped if any of them fails
+	group, groupCtx := errgroup.WithContext(ctx)
+	for _, f := range forwards {
+		expire := f.Expire
+		if expire == 0 {
+			expire = args.expire
+		}
+		network, bindAddr := splitScheme(f.Bind, "udp", "udp", "unixgram", "tun", "tproxy")
+		if f.Target != "" && (network == "tun" || network == "tproxy") {
+			mainLogger.Critical("Forwarding target can't be specified for %s listener", network)
+			return 3
+		}
+		if network == "tun" {
+			tunnel := client.NewTunnel(sessFactory, client.TunnelOptions{
+				Name:    bindAddr,
+				MTU:     args.tunMTU,
+				Address: args.tunAddr.IPNet,
+				Routes:  args.tunRoutes,
+				Logger:  listenerLogger,
+			})
+			group.Go(func() error {
+				return tunnel.Run(groupCtx)
+			})
+		} else {
+			listener := client.NewListener(sessFactory, client.ListenerOptions{
+				Bind:        bindAddr,
+				Network:     network,
+				SocketMode:  os.FileMode(args.socketMode),
+				Destination: f.Target,
+				Expire:      expire,
+				ACL:         peerACL,
+				Logger:      listenerLogger,
+			})
+			group.Go(func() error {
+				return listener.ListenAndServe(groupCtx)
+			})
+		}
+	}
+	err = group.Wait()
+	if err != nil && err != ctx.Err() {
 		mainLogger.Critical("Listener stopped with error: %v", err)
 	}
+	mainLogger.Info("Shutting down...")
 	return 0
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/Snawoot/udpierce/client"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeaderList is a flag.Value accumulating "Name: value" HTTP headers
+type HeaderList []string
+
+func (l *HeaderList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *HeaderList) Set(value string) error {
+	if _, _, err := splitHeader(value); err != nil {
+		return err
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+func (l HeaderList) Header() http.Header {
+	res := make(http.Header)
+	for _, h := range l {
+		name, value, _ := splitHeader(h)
+		res.Add(name, value)
+	}
+	return res
+}
+
+func splitHeader(h string) (string, string, error) {
+	idx := strings.IndexByte(h, ':')
+	if idx < 1 {
+		return "", "", fmt.Errorf("Bad header %q: expected \"Name: value\"", h)
+	}
+	return strings.TrimSpace(h[:idx]), strings.TrimSpace(h[idx+1:]), nil
+}
+
+// FileMode is a flag.Value holding octal file permissions
+type FileMode os.FileMode
+
+func (m *FileMode) String() string {
+	if *m == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%04o", uint32(*m))
+}
+
+func (m *FileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return fmt.Errorf("Bad file mode %q: expected octal permissions like 0660", value)
+	}
+	*m = FileMode(mode)
+	return nil
+}
+
+// Splits comma-separated list, dropping empty items
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// Splits address in form [scheme:]address. Prefix is treated as scheme
+// only if it is one of known schemes and isn't followed by bare port
+// number, otherwise defscheme is returned with whole address. So
+// "unix:8911" is port 8911 of host named "unix", not socket file "8911".
+func splitScheme(addr, defscheme string, schemes ...string) (string, string) {
+	if idx := strings.IndexByte(addr, ':'); idx >= 0 {
+		if _, err := strconv.ParseUint(addr[idx+1:], 10, 16); err == nil {
+			return defscheme, addr
+		}
+		for _, scheme := range schemes {
+			if addr[:idx] == scheme {
+				return scheme, addr[idx+1:]
+			}
+		}
+	}
+	return defscheme, addr
+}
+
+// CIDR is a flag.Value holding address with prefix length, e.g. 10.0.0.2/24
+type CIDR struct {
+	*net.IPNet
+}
+
+func (c *CIDR) String() string {
+	if c.IPNet == nil {
+		return ""
+	}
+	return c.IPNet.String()
+}
+
+func (c *CIDR) Set(value string) error {
+	ip, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	c.IPNet = &net.IPNet{IP: ip, Mask: network.Mask}
+	return nil
+}
+
+// CIDRList is a flag.Value accumulating networks
+type CIDRList []*net.IPNet
+
+func (l *CIDRList) String() string {
+	parts := make([]string, len(*l))
+	for i, n := range *l {
+		parts[i] = n.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (l *CIDRList) Set(value string) error {
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, network)
+	return nil
+}
+
+// HostMap is a flag.Value accumulating static hostname addresses in
+// form NAME=IP[,IP...]
+type HostMap map[string][]net.IP
+
+func (m *HostMap) String() string {
+	parts := make([]string, 0, len(*m))
+	for name, ips := range *m {
+		addrs := make([]string, len(ips))
+		for i, ip := range ips {
+			addrs[i] = ip.String()
+		}
+		parts = append(parts, name+"="+strings.Join(addrs, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (m *HostMap) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected NAME=IP[,IP...], got %q", value)
+	}
+	var ips []net.IP
+	for _, addr := range splitList(kv[1]) {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("bad IP address %q", addr)
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no addresses for %s", kv[0])
+	}
+	if *m == nil {
+		*m = make(HostMap)
+	}
+	(*m)[kv[0]] = append((*m)[kv[0]], ips...)
+	return nil
+}
+
+// PinList is a flag.Value accumulating public key pins
+type PinList [][]byte
+
+func (l *PinList) String() string {
+	parts := make([]string, len(*l))
+	for i, pin := range *l {
+		parts[i] = base64.StdEncoding.EncodeToString(pin)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (l *PinList) Set(value string) error {
+	pin, err := client.ParsePinSHA256(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, pin)
+	return nil
+}
+
+// Forward describes single client listener
+type Forward struct {
+	// Listen address, may have scheme prefix
+	Bind string
+	// Destination requested from server, optional
+	Target string
+	// Idle session lifetime, zero means default
+	Expire time.Duration
+}
+
+// ForwardList is a flag.Value accumulating forwardings specified as
+// BIND[=TARGET][,expire=DURATION]. There is no escaping, so BIND and
+// TARGET can't contain ',' and BIND can't contain '='.
+type ForwardList []Forward
+
+func (l *ForwardList) String() string {
+	parts := make([]string, len(*l))
+	for i, f := range *l {
+		parts[i] = f.Bind
+		if f.Target != "" {
+			parts[i] += "=" + f.Target
+		}
+		if f.Expire != 0 {
+			parts[i] += ",expire=" + f.Expire.String()
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *ForwardList) Set(value string) error {
+	fields := strings.Split(value, ",")
+	var f Forward
+	if idx := strings.IndexByte(fields[0], '='); idx >= 0 {
+		f.Bind, f.Target = fields[0][:idx], fields[0][idx+1:]
+	} else {
+		f.Bind = fields[0]
+	}
+	if f.Bind == "" {
+		return fmt.Errorf("Bad forwarding %q: empty bind address", value)
+	}
+	for _, opt := range fields[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Bad forwarding option %q: expected name=value", opt)
+		}
+		switch kv[0] {
+		case "expire":
+			expire, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return fmt.Errorf("Bad expire value %q: %v", kv[1], err)
+			}
+			f.Expire = expire
+		default:
+			return fmt.Errorf("Unknown forwarding option %q", kv[0])
+		}
+	}
+	*l = append(*l, f)
+	return nil
+}
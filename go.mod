@@ -1,8 +1,12 @@
 module github.com/Snawoot/udpierce
 
-go 1.14
+go 1.21
 
 require (
 	github.com/google/uuid v1.1.1
-	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.10.0
+	golang.org/x/sync v0.1.0
 )
+
+require golang.org/x/text v0.14.0 // indirect
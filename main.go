@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/Snawoot/udpierce/client"
+	"github.com/Snawoot/udpierce/proto"
+	"github.com/Snawoot/udpierce/resolver"
+	"github.com/Snawoot/udpierce/server"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 )
 
@@ -12,6 +21,11 @@ var (
 	version = "undefined"
 )
 
+const (
+	DEFAULT_SELF_SIGNED_CERT = "udpierce.pem"
+	DEFAULT_SELF_SIGNED_KEY  = "udpierce.key"
+)
+
 func perror(msg string) {
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, msg)
@@ -27,40 +41,291 @@ func arg_fail(msg string) {
 type CLIArgs struct {
 	server                   bool
 	bind, dst                string
+	forwards                 ForwardList
+	socketMode               FileMode
+	dstSocketMode            FileMode
+	tunMTU                   int
+	tunPool, tunAddr         CIDR
+	tunRoutes                CIDRList
 	verbosity                int
 	conns                    uint
 	backoff, timeout, expire time.Duration
+	maxBackoff               time.Duration
+	breakerThreshold         uint
+	breakerTimeout           time.Duration
 	cert, key, cafile        string
 	hostname_check           bool
 	tls_servername           string
 	password                 string
+	authScheme               string
+	username                 string
+	usersFile                string
+	authSkew                 time.Duration
+	psk                      string
+	padMode                  string
+	padSize                  int
+	coverInterval            time.Duration
+	httpMethod, httpPath     string
+	httpHost, headerPrefix   string
+	httpHeaders              HeaderList
+	helloStatus              string
+	helloHeaders             HeaderList
+	helloDate                bool
+	chainTLS                 bool
+	chainCAFile              string
+	chainAuth                string
+	chainUsername            string
+	chainPassword            string
+	chainPSK                 string
 	resolve_once             bool
+	dnsServers               string
+	dnsHosts                 HostMap
+	dnsMinTTL, dnsMaxTTL     time.Duration
+	sourceAddr               string
+	bindInterface            string
+	fwmark                   int
+	dscp                     int
+	sockopts                 *proto.SocketOptions
 	dialers                  uint
 	tls                      bool
+	ticketKeysFile           string
+	crlFile                  string
+	selfSigned               bool
+	muxBackend               string
+	muxServerNames           string
+	muxALPN                  string
+	acmeHosts                string
+	acmeCache                string
+	acmeDirectory            string
+	acmeEmail                string
+	acmeCAFile               string
+	certIdentities           string
+	proxyProtocol            bool
+	trustedProxies           CIDRList
+	trustUnixPeers           bool
+	forwardedFor             bool
+	clientCertHeader         string
+	tlsProfile               string
+	pins                     PinList
+	tlsALPN, tlsCiphers      string
+	tlsCurves                string
+	tlsMinVer, tlsMaxVer     string
+	tlsParams                *proto.TLSParams
+	ticketRotate             time.Duration
+	allowList, denyList      string
+	dynamicDst               bool
+	dstAllowList             string
+	dstDenyList              string
+	aclReload                time.Duration
 	showVersion              bool
 }
 
+func parse_tls_params(args *CLIArgs) *proto.TLSParams {
+	var (
+		params proto.TLSParams
+		err    error
+	)
+	params.ALPN = proto.ParseALPN(args.tlsALPN)
+	if params.CipherSuites, err = proto.ParseCipherSuites(args.tlsCiphers); err != nil {
+		arg_fail(err.Error())
+	}
+	if params.Curves, err = proto.ParseCurves(args.tlsCurves); err != nil {
+		arg_fail(err.Error())
+	}
+	if params.MinVersion, err = proto.ParseTLSVersion(args.tlsMinVer); err != nil {
+		arg_fail(err.Error())
+	}
+	if params.MaxVersion, err = proto.ParseTLSVersion(args.tlsMaxVer); err != nil {
+		arg_fail(err.Error())
+	}
+	if _, err = client.TLSProfile(args.tlsProfile); err != nil {
+		arg_fail(err.Error())
+	}
+	return &params
+}
+
+func parse_sockopts(args *CLIArgs) *proto.SocketOptions {
+	if args.sourceAddr == "" && args.bindInterface == "" && args.fwmark == 0 && args.dscp == 0 {
+		return nil
+	}
+	opts := proto.SocketOptions{
+		Interface: args.bindInterface,
+		Mark:      args.fwmark,
+		DSCP:      args.dscp,
+	}
+	if args.sourceAddr != "" {
+		if opts.SourceAddr = net.ParseIP(args.sourceAddr); opts.SourceAddr == nil {
+			arg_fail("Bad source address")
+		}
+	}
+	if args.dscp < 0 || args.dscp > 63 {
+		arg_fail("DSCP value should be in range 0-63")
+	}
+	if (args.bindInterface != "" || args.fwmark != 0 || args.dscp != 0) && runtime.GOOS != "linux" {
+		arg_fail("Interface binding, firewall mark and DSCP are supported only on Linux")
+	}
+	return &opts
+}
+
 func parse_args() *CLIArgs {
 	var args CLIArgs
 	flag.BoolVar(&args.server, "server", false, "server-side mode")
-	flag.StringVar(&args.bind, "bind", "0.0.0.0:8911", "listen address")
-	flag.StringVar(&args.dst, "dst", "", "forwarding address")
+	flag.StringVar(&args.bind, "bind", "0.0.0.0:8911", "listen address. Client also accepts \"unixgram:PATH\" "+
+		"for unix datagram socket, \"tun:IFNAME\" for TUN interface (Linux only) and \"tproxy:ADDR:PORT\" "+
+		"for transparent proxy socket receiving datagrams diverted by iptables TPROXY target (Linux only), "+
+		"server accepts \"unix:PATH\" for unix stream socket")
+	flag.Var(&args.forwards, "forward", "(client only) forwarding in form BIND[=TARGET][,expire=DURATION]: "+
+		"listen on BIND address like -bind option does and forward datagrams to TARGET address at server side. "+
+		"Server has to be started with -dynamic-dst option to accept TARGET. BIND and TARGET can't contain \",\" "+
+		"and BIND can't contain \"=\". Can be repeated. Overrides -bind")
+	flag.Var(&args.socketMode, "socket-mode", "octal permissions of unix socket file created for bind address")
+	flag.Var(&args.dstSocketMode, "dst-socket-mode", "(server only) octal permissions of per-session "+
+		"unix socket files created for \"unixgram:PATH\" destination")
+	flag.StringVar(&args.dst, "dst", "", "forwarding address. Server also accepts \"unixgram:PATH\" for unix datagram socket, "+
+		"\"tun:IFNAME\" for TUN interface (Linux only) and \"chain:HOST:PORT\" for another udpierce server")
 	flag.IntVar(&args.verbosity, "verbosity", 20, "logging verbosity "+
 		"(10 - debug, 20 - info, 30 - warning, 40 - error, 50 - critical)")
 	flag.UintVar(&args.conns, "conns", 4, "(client only) amount of parallel TLS connections")
 	flag.DurationVar(&args.timeout, "timeout", 10*time.Second, "connect timeout")
-	flag.DurationVar(&args.backoff, "backoff", 5*time.Second, "(client only) interval between failed connection attempts")
+	flag.DurationVar(&args.backoff, "backoff", client.DEFAULT_BACKOFF, "(client only) initial interval between failed "+
+		"connection attempts. Doubled with each consecutive failure up to -max-backoff and randomized")
+	flag.DurationVar(&args.maxBackoff, "max-backoff", client.DEFAULT_MAX_BACKOFF, "(client only) limit of interval "+
+		"between failed connection attempts")
+	flag.UintVar(&args.breakerThreshold, "breaker-threshold", client.DEFAULT_BREAKER_THRESHOLD, "(client only) "+
+		"consecutive connection failures after which server is considered down and connection attempts are suspended")
+	flag.DurationVar(&args.breakerTimeout, "breaker-timeout", client.DEFAULT_BREAKER_TIMEOUT, "(client only) "+
+		"time for which connection attempts are suspended once server is considered down")
 	flag.DurationVar(&args.expire, "expire", 2*time.Minute, "(client only) idle session lifetime")
 	flag.StringVar(&args.cert, "cert", "", "use certificate for peer TLS auth")
 	flag.StringVar(&args.key, "key", "", "key for TLS certificate")
 	flag.StringVar(&args.cafile, "cafile", "", "client: override default CA certs by specified in file / "+
 		"server: require client TLS auth verified by given CAs")
+	flag.BoolVar(&args.selfSigned, "self-signed", false, "(server only) generate self-signed certificate into -cert and -key "+
+		"files on first start and log its public key pin for -pin-sha256 client option. "+
+		"Files default to "+DEFAULT_SELF_SIGNED_CERT+" and "+DEFAULT_SELF_SIGNED_KEY)
+	flag.StringVar(&args.muxBackend, "mux-backend", "", "(server only) TCP address of backend, e.g. web server, "+
+		"to pass connections not matched by -mux-sni and -mux-alpn to. Enables sharing of server port")
+	flag.StringVar(&args.muxServerNames, "mux-sni", "", "(server only) comma-separated list of TLS server names "+
+		"handled by udpierce when -mux-backend is set. Empty list matches any name")
+	flag.StringVar(&args.muxALPN, "mux-alpn", "", "(server only) comma-separated list of ALPN protocols "+
+		"handled by udpierce when -mux-backend is set: clients have to offer one of them. Empty list matches any client")
+	flag.StringVar(&args.acmeHosts, "acme-hosts", "", "(server only) comma-separated list of hostnames to obtain "+
+		"certificates for with ACME. Enables ACME instead of -cert and -key. Challenges are answered on server port: "+
+		"TLS-ALPN-01 and HTTP-01 if plain HTTP port 80 is forwarded to it")
+	flag.StringVar(&args.acmeCache, "acme-cache", "acme-cache", "(server only) directory for ACME account key and certificates")
+	flag.StringVar(&args.acmeDirectory, "acme-directory", autocert.DefaultACMEDirectory, "(server only) ACME directory URL")
+	flag.StringVar(&args.acmeEmail, "acme-email", "", "(server only) contact email for ACME account")
+	flag.StringVar(&args.acmeCAFile, "acme-cafile", "", "(server only) override default CA certs for ACME server "+
+		"connections, e.g. for test servers like Pebble")
+	flag.StringVar(&args.crlFile, "crl", "", "(server only) file with certificate revocation lists signed by CAs from -cafile. "+
+		"Client certificates revoked by them are rejected. Reloaded on change with -acl-reload interval")
+	flag.StringVar(&args.certIdentities, "cert-identities", "", "(server only) file with rules mapping client certificates "+
+		"verified by -cafile to identities: \"MATCHER IDENTITY [OPTION...]\" per line, where MATCHER is cn:NAME, san:NAME, "+
+		"sha256:FINGERPRINT, serial:SERIAL or *, and options are dst=CIDR[,CIDR...], max-sessions=N and revoked. "+
+		"Certificates matching no rule are rejected. Reloaded on change with -acl-reload interval")
+	flag.BoolVar(&args.proxyProtocol, "proxy-protocol", false, "(server only) expect PROXY protocol v1 or v2 header "+
+		"on connections from -trusted-proxy networks and take client address from it")
+	flag.Var(&args.trustedProxies, "trusted-proxy", "(server only) network of reverse proxy trusted to pass client "+
+		"address and certificate, e.g. 10.0.0.0/8. Can be repeated")
+	flag.BoolVar(&args.trustUnixPeers, "trust-unix-peers", false, "(server only) trust peers of unix socket bind "+
+		"address like -trusted-proxy networks. Any local process which can connect to socket may spoof client "+
+		"address and certificate then")
+	flag.BoolVar(&args.forwardedFor, "forwarded-for", false, "(server only) take client address from "+
+		"X-Forwarded-For header of requests from -trusted-proxy networks")
+	flag.StringVar(&args.clientCertHeader, "client-cert-header", "", "(server only) name of header with URL-encoded PEM "+
+		"client certificate passed by -trusted-proxy, e.g. for nginx $ssl_client_escaped_cert. "+
+		"Certificate is verified against -cafile and used like TLS client certificate")
 	flag.BoolVar(&args.hostname_check, "hostname-check", true, "(client only) check hostname in server cert subject")
+	flag.Var(&args.pins, "pin-sha256", "(client only) base64 or hex encoded SHA-256 hash of allowed server "+
+		"certificate public key. Checked in addition to chain verification. With -hostname-check=false "+
+		"and without -cafile only server certificate key is checked. Can be repeated")
 	flag.StringVar(&args.tls_servername, "tls-servername", "", "(client only) specifies hostname to expect in server cert")
 	flag.StringVar(&args.password, "password", "", "use password authentication")
-	flag.BoolVar(&args.resolve_once, "resolve-once", false, "(client only) resolve server hostname once on start")
+	flag.StringVar(&args.authScheme, "auth", proto.AUTH_STATIC, "password authentication scheme: "+
+		"\""+proto.AUTH_STATIC+"\" sends password as is, \""+proto.AUTH_HMAC+"\" sends replay-resistant time-based token")
+	flag.StringVar(&args.username, "username", "", "(client only) username for "+proto.AUTH_HMAC+" authentication")
+	flag.StringVar(&args.usersFile, "users", "", "(server only) file with username:password lines for "+
+		proto.AUTH_HMAC+" authentication. Overrides -password")
+	flag.DurationVar(&args.authSkew, "auth-skew", time.Minute, "(server only) allowed clock difference for "+
+		proto.AUTH_HMAC+" authentication")
+	flag.BoolVar(&args.resolve_once, "resolve-once", false, "(client only) resolve server hostname once on start "+
+		"instead of each connection attempt")
+	flag.StringVar(&args.dnsServers, "dns", "", "comma-separated list of DNS servers tried in order instead of "+
+		"system resolver: \"udp://HOST[:PORT]\" or \"HOST[:PORT]\" for plain DNS, \"tls://HOST[:PORT]\" for DNS-over-TLS, "+
+		"\"https://HOST[:PORT]/PATH\" for DNS-over-HTTPS. Client uses it for server hostname, server - for destination hostname")
+	flag.Var(&args.dnsHosts, "dns-host", "static addresses of hostname in form NAME=IP[,IP...]. "+
+		"Take precedence over DNS servers and are also used to resolve their hostnames. Can be repeated")
+	flag.DurationVar(&args.dnsMinTTL, "dns-min-ttl", resolver.DEFAULT_MIN_TTL, "minimal time to cache DNS answers for. "+
+		"System resolver answers are always cached for this time")
+	flag.DurationVar(&args.dnsMaxTTL, "dns-max-ttl", resolver.DEFAULT_MAX_TTL, "maximal time to cache DNS answers for")
+	flag.StringVar(&args.sourceAddr, "source-addr", "", "local IP address of outgoing connections: connections to server "+
+		"and -dns servers on client, connections to destination and -dns servers on server. System resolver isn't affected")
+	flag.StringVar(&args.bindInterface, "bind-interface", "", "bind outgoing connections to network interface "+
+		"(SO_BINDTODEVICE, Linux only)")
+	flag.IntVar(&args.fwmark, "fwmark", 0, "firewall mark of outgoing connections for policy routing (SO_MARK, Linux only)")
+	flag.IntVar(&args.dscp, "dscp", 0, "DSCP value 0-63 of outgoing packets (Linux only)")
 	flag.UintVar(&args.dialers, "dialers", uint(runtime.GOMAXPROCS(0)), "(client only) concurrency limit for TLS connection attempts")
 	flag.BoolVar(&args.tls, "tls", true, "use TLS")
+	flag.StringVar(&args.tlsProfile, "tls-profile", client.PROFILE_GO, "(client only) TLS ClientHello profile: "+
+		"\""+client.PROFILE_GO+"\" (crypto/tls defaults), \""+client.PROFILE_CHROME+"\", \""+client.PROFILE_FIREFOX+"\" "+
+		"(cipher suites, curves and http/1.1 ALPN resembling browser) or \""+client.PROFILE_RANDOM+"\" (random subsets of cipher suites and curves)")
+	flag.StringVar(&args.tlsALPN, "tls-alpn", "", "comma-separated list of TLS application protocols, e.g. \"h2,http/1.1\". "+
+		"Client offers them, server accepts them. Offer h2 only if client connects to udpierce server directly: "+
+		"TLS-terminating proxy or CDN negotiating h2 breaks connection")
+	flag.StringVar(&args.tlsCiphers, "tls-ciphers", "", "comma-separated list of TLS 1.0-1.2 cipher suites "+
+		"to offer or accept, e.g. \"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305\"")
+	flag.StringVar(&args.tlsCurves, "tls-curves", "", "comma-separated list of TLS key exchange curves "+
+		"to offer or accept: X25519, P256, P384, P521 or numeric group IDs")
+	flag.StringVar(&args.tlsMinVer, "tls-min-version", "", "minimal TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&args.tlsMaxVer, "tls-max-version", "", "maximal TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&args.ticketKeysFile, "tls-ticket-keys", "", "(server only) file with TLS session ticket keys "+
+		"shared across servers: one hex-encoded 32-byte key per line, first key encrypts new tickets. "+
+		"Keys are generated in memory if not set")
+	flag.DurationVar(&args.ticketRotate, "tls-ticket-rotate", server.DEFAULT_TICKET_ROTATE, "(server only) "+
+		"interval of TLS session ticket key rotation. With -tls-ticket-keys it's interval between checks of keys file for changes")
+	flag.StringVar(&args.psk, "psk", "", "enable end-to-end AES-GCM encryption of datagrams with given pre-shared key")
+	flag.StringVar(&args.allowList, "allow-list", "", "file with CIDR list of peers allowed to connect. "+
+		"Client checks UDP senders, server checks incoming connections")
+	flag.StringVar(&args.denyList, "deny-list", "", "file with CIDR list of peers denied to connect. "+
+		"Takes precedence over allow list")
+	flag.DurationVar(&args.aclReload, "acl-reload", 30*time.Second, "interval between checks of allow/deny list, CRL and certificate identity files for changes. "+
+		"Zero disables reload")
+	flag.StringVar(&args.padMode, "pad-mode", proto.PAD_NONE, "frame padding mode: "+
+		"\""+proto.PAD_NONE+"\", \""+proto.PAD_UNIFORM+"\" (random padding up to pad-size), "+
+		"\""+proto.PAD_EXP+"\" (exponentially distributed padding with mean pad-size), "+
+		"\""+proto.PAD_FIXED+"\" (frames padded to multiple of pad-size). Must match on both sides")
+	flag.IntVar(&args.padSize, "pad-size", 256, "padding size parameter, see pad-mode")
+	flag.DurationVar(&args.coverInterval, "cover-interval", 0, "average idle interval after which dummy cover frame is sent. "+
+		"Requires pad-mode other than \""+proto.PAD_NONE+"\"")
+	flag.StringVar(&args.httpMethod, "http-method", proto.DEFAULT_METHOD, "HTTP method of connection request")
+	flag.StringVar(&args.httpPath, "http-path", proto.DEFAULT_PATH, "HTTP path of connection request")
+	flag.StringVar(&args.httpHost, "http-host", "", "(client only) Host header of connection request. "+
+		"Defaults to server hostname for methods other than CONNECT")
+	flag.StringVar(&args.headerPrefix, "header-prefix", proto.DEFAULT_HEADER_PREFIX, "name prefix of protocol HTTP headers")
+	flag.Var(&args.httpHeaders, "http-header", "(client only) extra \"Name: value\" header of connection request. "+
+		"Can be repeated")
+	flag.StringVar(&args.helloStatus, "hello-status", proto.DEFAULT_HELLO_STATUS, "(server only) HTTP status of server response. Has to be 2xx")
+	flag.Var(&args.helloHeaders, "hello-header", "(server only) extra \"Name: value\" header of server response. "+
+		"Can be repeated")
+	flag.BoolVar(&args.helloDate, "hello-date", false, "(server only) add Date header to server response")
+	flag.BoolVar(&args.chainTLS, "chain-tls", true, "(server only) use TLS for chained udpierce server")
+	flag.StringVar(&args.chainCAFile, "chain-cafile", "", "(server only) override default CA certs for chained udpierce server")
+	flag.StringVar(&args.chainAuth, "chain-auth", proto.AUTH_STATIC, "(server only) password authentication scheme for chained udpierce server")
+	flag.StringVar(&args.chainUsername, "chain-username", "", "(server only) username for chained udpierce server")
+	flag.StringVar(&args.chainPassword, "chain-password", "", "(server only) password for chained udpierce server")
+	flag.StringVar(&args.chainPSK, "chain-psk", "", "(server only) payload encryption key for chained udpierce server")
+	flag.BoolVar(&args.dynamicDst, "dynamic-dst", false, "(server only) allow clients to choose UDP destination "+
+		"of session. Used by client in tproxy mode")
+	flag.StringVar(&args.dstAllowList, "dst-allow-list", "", "(server only) file with CIDR list of destinations "+
+		"clients are allowed to choose")
+	flag.StringVar(&args.dstDenyList, "dst-deny-list", "", "(server only) file with CIDR list of destinations "+
+		"clients are not allowed to choose. Takes precedence over allow list")
+	flag.IntVar(&args.tunMTU, "tun-mtu", 0, "MTU of TUN interface. Zero leaves default")
+	flag.Var(&args.tunPool, "tun-pool", "(server only) network to assign TUN client addresses from, e.g. 10.99.0.0/24. "+
+		"First host address is assigned to server interface")
+	flag.Var(&args.tunAddr, "tun-addr", "(client only) TUN interface address, e.g. 10.99.0.2/24. "+
+		"Address assigned by server takes precedence")
+	flag.Var(&args.tunRoutes, "tun-route", "(client only) network routed through TUN interface. Can be repeated")
 	flag.BoolVar(&args.showVersion, "version", false, "show program version and exit")
 	flag.Parse()
 
@@ -75,13 +340,92 @@ func parse_args() *CLIArgs {
 	if args.conns == 0 {
 		args.conns = 1
 	}
+	if args.authScheme != proto.AUTH_STATIC && args.authScheme != proto.AUTH_HMAC {
+		arg_fail("Unknown authentication scheme!")
+	}
 	if args.dialers < 1 {
 		arg_fail("dialers parameter should be not less than 1")
 	}
+	if args.selfSigned {
+		if !args.tls {
+			arg_fail("Self-signed certificate requires TLS")
+		}
+		if args.cert == "" {
+			args.cert = DEFAULT_SELF_SIGNED_CERT
+		}
+		if args.key == "" {
+			args.key = DEFAULT_SELF_SIGNED_KEY
+		}
+	}
+	if args.muxBackend != "" && !args.tls {
+		arg_fail("Port sharing requires TLS")
+	}
+	if args.acmeHosts != "" {
+		if !args.tls {
+			arg_fail("ACME requires TLS")
+		}
+		if args.selfSigned || args.cert != "" || args.key != "" {
+			arg_fail("ACME can't be used together with -self-signed, -cert or -key")
+		}
+	}
+	if args.crlFile != "" && args.cafile == "" {
+		arg_fail("CRL requires CA file")
+	}
+	if args.clientCertHeader != "" && args.cafile == "" {
+		arg_fail("Client certificate header requires CA file")
+	}
+	if args.certIdentities != "" && (args.cafile == "" || (!args.tls && args.clientCertHeader == "")) {
+		arg_fail("Certificate identities require CA file and either TLS or client certificate header")
+	}
+	if (args.proxyProtocol || args.forwardedFor || args.clientCertHeader != "") &&
+		len(args.trustedProxies) == 0 && !args.trustUnixPeers {
+		arg_fail("-proxy-protocol, -forwarded-for and -client-cert-header require -trusted-proxy " +
+			"or -trust-unix-peers")
+	}
+	if args.server && args.dynamicDst {
+		if scheme, _ := splitScheme(args.dst, "udp", sinkSchemes...); scheme != "udp" {
+			arg_fail("-dynamic-dst requires UDP destination")
+		}
+	}
+	if args.dnsMinTTL <= 0 || args.dnsMaxTTL < args.dnsMinTTL {
+		arg_fail("Bad DNS cache time bounds")
+	}
+	args.sockopts = parse_sockopts(&args)
+	args.tlsParams = parse_tls_params(&args)
 	return &args
 }
 
+func makeResolver(args *CLIArgs, logger *CondLogger) (*resolver.Resolver, error) {
+	return resolver.New(resolver.Options{
+		Servers:       splitList(args.dnsServers),
+		Hosts:         args.dnsHosts,
+		MinTTL:        args.dnsMinTTL,
+		MaxTTL:        args.dnsMaxTTL,
+		SocketOptions: args.sockopts,
+		Logger:        logger,
+	})
+}
+
+// Returns context which is cancelled on termination signal
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		os.Exit(ca_main(os.Args[2:]))
+	}
 	args := parse_args()
 	if args.server {
 		os.Exit(server_main(args))
@@ -0,0 +1,407 @@
+// Package pki implements minimal certificate authority for mutual TLS
+// between udpierce clients and servers
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File names inside CA directory
+const (
+	CA_CERT_FILE = "ca.pem"
+	CA_KEY_FILE  = "ca.key"
+	CRL_FILE     = "crl.pem"
+)
+
+const (
+	DEFAULT_CA_VALIDITY   = 10 * 365 * 24 * time.Hour
+	DEFAULT_CERT_VALIDITY = 2 * 365 * 24 * time.Hour
+	// Interval between CRL updates expected by CRL consumers. Server
+	// doesn't enforce it, but CRL is regenerated with new NextUpdate on
+	// each revocation.
+	CRL_VALIDITY = 365 * 24 * time.Hour
+)
+
+// Allowed clock difference between issuer and peers
+const backdate = time.Hour
+
+// CA is a certificate authority stored in directory
+type CA struct {
+	dir  string
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// Generates new private key
+func GenerateKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// Generates random serial number
+func NewSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+}
+
+// Encodes key in PEM format
+func EncodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Encodes DER certificate in PEM format
+func EncodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// Reads first PEM certificate from file
+func LoadCert(filename string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("No certificate found in %s", filename)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// Creates CA with self-signed certificate in directory. Existing CA
+// is never overwritten.
+func InitCA(dir, name string, validity time.Duration) (*CA, error) {
+	if validity <= 0 {
+		validity = DEFAULT_CA_VALIDITY
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, CA_KEY_FILE)); err == nil {
+		return nil, fmt.Errorf("CA already exists in %s", dir)
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := NewSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := EncodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(filepath.Join(dir, CA_KEY_FILE), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := writeFile(filepath.Join(dir, CA_CERT_FILE), EncodeCert(der), 0644); err != nil {
+		return nil, err
+	}
+	ca := &CA{
+		dir:  dir,
+		cert: cert,
+		key:  key,
+	}
+	if err := ca.writeCRL(nil, big.NewInt(1)); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// Loads CA from directory
+func LoadCA(dir string) (*CA, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, CA_CERT_FILE), filepath.Join(dir, CA_KEY_FILE))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported CA key type")
+	}
+	return &CA{
+		dir:  dir,
+		cert: cert,
+		key:  key,
+	}, nil
+}
+
+// Returns CA certificate
+func (ca *CA) Certificate() *x509.Certificate {
+	return ca.cert
+}
+
+func (ca *CA) issue(template *x509.Certificate, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	if validity <= 0 {
+		validity = DEFAULT_CERT_VALIDITY
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := NewSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template.SerialNumber = serial
+	template.NotBefore = now.Add(-backdate)
+	template.NotAfter = now.Add(validity)
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.BasicConstraintsValid = true
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = EncodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return EncodeCert(der), keyPEM, nil
+}
+
+// Issues client certificate with given common name. Returns PEM
+// encoded certificate and key.
+func (ca *CA) IssueClient(name string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	return ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, validity)
+}
+
+// Issues server certificate for given hostnames and IP addresses.
+// First host becomes common name. Returns PEM encoded certificate and
+// key.
+func (ca *CA) IssueServer(hosts []string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	if len(hosts) == 0 {
+		return nil, nil, errors.New("At least one hostname is required")
+	}
+	template := x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0]},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	addHosts(&template, hosts)
+	return ca.issue(&template, validity)
+}
+
+// Returns base64 encoded SHA-256 hash of certificate public key, as
+// accepted by -pin-sha256 option of client
+func SPKIFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Loads certificate from certfile, generating self-signed certificate
+// for given hosts with key in keyfile if certfile doesn't exist yet.
+// Reports whether certificate was generated.
+func EnsureSelfSigned(certfile, keyfile string, hosts []string) (*x509.Certificate, bool, error) {
+	if _, err := os.Stat(certfile); err == nil {
+		cert, err := LoadCert(certfile)
+		return cert, false, err
+	} else if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	if len(hosts) == 0 {
+		return nil, false, errors.New("At least one hostname is required")
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, false, err
+	}
+	serial, err := NewSerial()
+	if err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(DEFAULT_CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	addHosts(&template, hosts)
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, false, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, false, err
+	}
+	keyPEM, err := EncodeKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := writeFile(keyfile, keyPEM, 0600); err != nil {
+		return nil, false, err
+	}
+	if err := writeFile(certfile, EncodeCert(der), 0644); err != nil {
+		return nil, false, err
+	}
+	return cert, true, nil
+}
+
+func addHosts(template *x509.Certificate, hosts []string) {
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+}
+
+// Adds serial number to CRL of CA. Revoking already revoked serial is
+// not an error.
+func (ca *CA) Revoke(serial *big.Int) error {
+	crl, err := ca.loadCRL()
+	if err != nil {
+		return err
+	}
+	entries := crl.RevokedCertificateEntries
+	for _, entry := range entries {
+		if entry.SerialNumber.Cmp(serial) == 0 {
+			return nil
+		}
+	}
+	entries = append(entries, x509.RevocationListEntry{
+		SerialNumber:   serial,
+		RevocationTime: time.Now(),
+	})
+	return ca.writeCRL(entries, new(big.Int).Add(crl.Number, big.NewInt(1)))
+}
+
+func (ca *CA) loadCRL() (*x509.RevocationList, error) {
+	data, err := ioutil.ReadFile(filepath.Join(ca.dir, CRL_FILE))
+	if err != nil {
+		return nil, err
+	}
+	return ParseCRL(data, ca.cert)
+}
+
+func (ca *CA) writeCRL(entries []x509.RevocationListEntry, number *big.Int) error {
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(CRL_VALIDITY),
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(ca.dir, CRL_FILE),
+		pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+}
+
+// Parses PEM or DER encoded CRL. If issuer is given, CRL signature is
+// verified with it.
+func ParseCRL(data []byte, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+	if issuer != nil {
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			return nil, fmt.Errorf("CRL signature check failed: %v", err)
+		}
+	}
+	return crl, nil
+}
+
+// Parses serial number in decimal form or in hex form with "0x" prefix
+// or colon-separated bytes, as printed by openssl
+func ParseSerial(s string) (*big.Int, error) {
+	var (
+		serial *big.Int
+		ok     bool
+	)
+	switch {
+	case strings.Contains(s, ":"):
+		serial, ok = new(big.Int).SetString(strings.Replace(s, ":", "", -1), 16)
+	default:
+		serial, ok = new(big.Int).SetString(s, 0)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Bad serial number %q", s)
+	}
+	return serial, nil
+}
+
+// Formats serial number as colon-separated hex bytes
+func FormatSerial(serial *big.Int) string {
+	b := serial.Bytes()
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02X", c)
+	}
+	return strings.Join(parts, ":")
+}
+
+// Writes file atomically, so readers never see partial content
+func writeFile(filename string, data []byte, perm os.FileMode) error {
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,189 @@
+package proto
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUTH_STATIC = "static"
+	AUTH_HMAC   = "hmac"
+)
+
+const AUTH_NONCE_BYTES = 16
+
+type ClientAuth struct {
+	scheme   string
+	username string
+	password string
+}
+
+func NewClientAuth(scheme, username, password string) (*ClientAuth, error) {
+	switch scheme {
+	case AUTH_STATIC:
+	case AUTH_HMAC:
+		if password == "" {
+			return nil, errors.New("HMAC authentication requires password")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown authentication scheme %q", scheme)
+	}
+	return &ClientAuth{
+		scheme:   scheme,
+		username: username,
+		password: password,
+	}, nil
+}
+
+// Adds authentication headers for new connection of session
+func (a *ClientAuth) SetHeaders(header http.Header, prefix, sess_id string) error {
+	if a == nil {
+		return nil
+	}
+	if a.scheme == AUTH_STATIC {
+		header.Set(prefix+HDR_PASSWD, a.password)
+		return nil
+	}
+	noncebuf := make([]byte, AUTH_NONCE_BYTES)
+	if _, err := rand.Read(noncebuf); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(noncebuf)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	header.Set(prefix+HDR_USER, a.username)
+	header.Set(prefix+HDR_TIME, ts)
+	header.Set(prefix+HDR_NONCE, nonce)
+	header.Set(prefix+HDR_AUTH, hex.EncodeToString(authMAC(a.password, sess_id, ts, nonce)))
+	return nil
+}
+
+func authMAC(password, sess_id, ts, nonce string) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(sess_id))
+	mac.Write([]byte(ts))
+	mac.Write([]byte(nonce))
+	return mac.Sum(nil)
+}
+
+// HMACVerifier checks time-based authentication tokens. Each nonce is
+// accepted only once within clock skew window.
+type HMACVerifier struct {
+	password string
+	users    map[string]string
+	skew     time.Duration
+	nonces   map[string]time.Time
+	noncemux sync.Mutex
+	lastGC   time.Time
+}
+
+func NewHMACVerifier(password, usersfile string, skew time.Duration) (*HMACVerifier, error) {
+	v := &HMACVerifier{
+		password: password,
+		skew:     skew,
+		nonces:   make(map[string]time.Time),
+	}
+	if usersfile != "" {
+		users, err := loadUsers(usersfile)
+		if err != nil {
+			return nil, err
+		}
+		v.users = users
+	} else if password == "" {
+		return nil, errors.New("HMAC authentication requires password or users file")
+	}
+	return v, nil
+}
+
+// Reads file with "username:password" lines
+func loadUsers(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx < 0 {
+			return nil, fmt.Errorf("%s:%d: expected username:password", filename, lineno)
+		}
+		users[line[:idx]] = line[idx+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (v *HMACVerifier) Verify(header http.Header, prefix, sess_id string) (string, error) {
+	username := header.Get(prefix + HDR_USER)
+	ts := header.Get(prefix + HDR_TIME)
+	nonce := header.Get(prefix + HDR_NONCE)
+	password := v.password
+	if v.users != nil {
+		var ok bool
+		password, ok = v.users[username]
+		if !ok {
+			return username, errors.New("unknown user")
+		}
+	}
+	sig, err := hex.DecodeString(header.Get(prefix + HDR_AUTH))
+	if err != nil {
+		return username, errors.New("malformed token")
+	}
+	if len(nonce) != 2*AUTH_NONCE_BYTES {
+		return username, errors.New("malformed nonce")
+	}
+	if !hmac.Equal(sig, authMAC(password, sess_id, ts, nonce)) {
+		return username, errors.New("token mismatch")
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return username, errors.New("malformed timestamp")
+	}
+	now := time.Now()
+	issued := time.Unix(unix, 0)
+	if issued.Before(now.Add(-v.skew)) || issued.After(now.Add(v.skew)) {
+		return username, fmt.Errorf("timestamp is off by %v", now.Sub(issued))
+	}
+	if !v.useNonce(nonce, now) {
+		return username, errors.New("replayed nonce")
+	}
+	return username, nil
+}
+
+// Registers nonce as used. Returns false if nonce was seen already.
+func (v *HMACVerifier) useNonce(nonce string, now time.Time) bool {
+	v.noncemux.Lock()
+	defer v.noncemux.Unlock()
+	if now.Sub(v.lastGC) > v.skew {
+		for k, exp := range v.nonces {
+			if now.After(exp) {
+				delete(v.nonces, k)
+			}
+		}
+		v.lastGC = now
+	}
+	if _, seen := v.nonces[nonce]; seen {
+		return false
+	}
+	// Token with this nonce can't pass timestamp check after 2*skew
+	v.nonces[nonce] = now.Add(2 * v.skew)
+	return true
+}
@@ -0,0 +1,266 @@
+package proto
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testPrefix = "X-Test-"
+
+func TestHMACAuth(t *testing.T) {
+	const (
+		sessID = "3f8c2a1e-5b7d-4c9e-8f01-23456789abcd"
+		skew   = time.Minute
+	)
+	hmacHeader := func(t *testing.T, username, password string) http.Header {
+		auth, err := NewClientAuth(AUTH_HMAC, username, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := make(http.Header)
+		if err := auth.SetHeaders(header, testPrefix, sessID); err != nil {
+			t.Fatal(err)
+		}
+		return header
+	}
+	// Token issued at given time with valid signature
+	tokenAt := func(password string, issued time.Time) http.Header {
+		ts := strconv.FormatInt(issued.Unix(), 10)
+		nonce := hex.EncodeToString(make([]byte, AUTH_NONCE_BYTES))
+		header := make(http.Header)
+		header.Set(testPrefix+HDR_TIME, ts)
+		header.Set(testPrefix+HDR_NONCE, nonce)
+		header.Set(testPrefix+HDR_AUTH, hex.EncodeToString(authMAC(password, sessID, ts, nonce)))
+		return header
+	}
+	cases := []struct {
+		name    string
+		header  func(t *testing.T) http.Header
+		sessID  string
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			header: func(t *testing.T) http.Header { return hmacHeader(t, "", "secret") },
+		},
+		{
+			name:    "wrong password",
+			header:  func(t *testing.T) http.Header { return hmacHeader(t, "", "guess") },
+			wantErr: true,
+		},
+		{
+			name:    "other session",
+			header:  func(t *testing.T) http.Header { return hmacHeader(t, "", "secret") },
+			sessID:  "00000000-0000-0000-0000-000000000000",
+			wantErr: true,
+		},
+		{
+			name: "tampered signature",
+			header: func(t *testing.T) http.Header {
+				h := hmacHeader(t, "", "secret")
+				sig, _ := hex.DecodeString(h.Get(testPrefix + HDR_AUTH))
+				sig[0] ^= 1
+				h.Set(testPrefix+HDR_AUTH, hex.EncodeToString(sig))
+				return h
+			},
+			wantErr: true,
+		},
+		{
+			name: "tampered timestamp",
+			header: func(t *testing.T) http.Header {
+				h := hmacHeader(t, "", "secret")
+				ts, _ := strconv.ParseInt(h.Get(testPrefix+HDR_TIME), 10, 64)
+				h.Set(testPrefix+HDR_TIME, strconv.FormatInt(ts+1, 10))
+				return h
+			},
+			wantErr: true,
+		},
+		{
+			name: "tampered nonce",
+			header: func(t *testing.T) http.Header {
+				h := hmacHeader(t, "", "secret")
+				nonce := []byte(h.Get(testPrefix + HDR_NONCE))
+				nonce[0] ^= 1
+				h.Set(testPrefix+HDR_NONCE, string(nonce))
+				return h
+			},
+			wantErr: true,
+		},
+		{
+			name: "malformed signature",
+			header: func(t *testing.T) http.Header {
+				h := hmacHeader(t, "", "secret")
+				h.Set(testPrefix+HDR_AUTH, "zz")
+				return h
+			},
+			wantErr: true,
+		},
+		{
+			name: "short nonce",
+			header: func(t *testing.T) http.Header {
+				ts := strconv.FormatInt(time.Now().Unix(), 10)
+				h := make(http.Header)
+				h.Set(testPrefix+HDR_TIME, ts)
+				h.Set(testPrefix+HDR_NONCE, "00")
+				h.Set(testPrefix+HDR_AUTH, hex.EncodeToString(authMAC("secret", sessID, ts, "00")))
+				return h
+			},
+			wantErr: true,
+		},
+		{
+			name:    "missing headers",
+			header:  func(t *testing.T) http.Header { return make(http.Header) },
+			wantErr: true,
+		},
+		{
+			name:   "within skew in past",
+			header: func(t *testing.T) http.Header { return tokenAt("secret", time.Now().Add(-skew/2)) },
+		},
+		{
+			name:   "within skew in future",
+			header: func(t *testing.T) http.Header { return tokenAt("secret", time.Now().Add(skew/2)) },
+		},
+		{
+			name:    "expired",
+			header:  func(t *testing.T) http.Header { return tokenAt("secret", time.Now().Add(-2*skew)) },
+			wantErr: true,
+		},
+		{
+			name:    "from future",
+			header:  func(t *testing.T) http.Header { return tokenAt("secret", time.Now().Add(2*skew)) },
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v, err := NewHMACVerifier("secret", "", skew)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id := c.sessID
+			if id == "" {
+				id = sessID
+			}
+			_, err = v.Verify(c.header(t), testPrefix, id)
+			if c.wantErr && err == nil {
+				t.Fatal("token accepted, want rejection")
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("token rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestHMACReplay(t *testing.T) {
+	v, err := NewHMACVerifier("secret", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, _ := NewClientAuth(AUTH_HMAC, "", "secret")
+	header := make(http.Header)
+	auth.SetHeaders(header, testPrefix, "sess")
+	if _, err := v.Verify(header, testPrefix, "sess"); err != nil {
+		t.Fatalf("first use rejected: %v", err)
+	}
+	if _, err := v.Verify(header, testPrefix, "sess"); err == nil {
+		t.Fatal("replayed token accepted")
+	}
+	// Fresh token of same session is fine
+	header = make(http.Header)
+	auth.SetHeaders(header, testPrefix, "sess")
+	if _, err := v.Verify(header, testPrefix, "sess"); err != nil {
+		t.Fatalf("fresh token rejected: %v", err)
+	}
+}
+
+func TestHMACNonceExpiry(t *testing.T) {
+	v, err := NewHMACVerifier("secret", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if !v.useNonce("a", now) {
+		t.Fatal("new nonce rejected")
+	}
+	if v.useNonce("a", now.Add(time.Minute)) {
+		t.Fatal("nonce accepted twice within window")
+	}
+	// Collection runs once per skew and drops nonces past 2*skew
+	v.useNonce("b", now.Add(3*time.Minute))
+	if _, ok := v.nonces["a"]; ok {
+		t.Fatal("expired nonce kept")
+	}
+	if _, ok := v.nonces["b"]; !ok {
+		t.Fatal("fresh nonce dropped")
+	}
+}
+
+func TestHMACUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "udpierce-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	usersfile := filepath.Join(dir, "users")
+	content := "# comment\n\nalice:pa:ss\nbob:hunter2\n"
+	if err := ioutil.WriteFile(usersfile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewHMACVerifier("", usersfile, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		username, password string
+		wantErr            bool
+	}{
+		{"alice", "pa:ss", false},
+		{"bob", "hunter2", false},
+		{"bob", "pa:ss", true},
+		{"carol", "hunter2", true},
+	}
+	for _, c := range cases {
+		auth, _ := NewClientAuth(AUTH_HMAC, c.username, c.password)
+		header := make(http.Header)
+		auth.SetHeaders(header, testPrefix, "sess")
+		username, err := v.Verify(header, testPrefix, "sess")
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s:%s: got error %v, want error %v", c.username, c.password, err, c.wantErr)
+		}
+		if username != c.username {
+			t.Errorf("got username %q, want %q", username, c.username)
+		}
+	}
+
+	if err := ioutil.WriteFile(usersfile, []byte("alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHMACVerifier("", usersfile, time.Minute); err == nil {
+		t.Fatal("malformed users file accepted")
+	}
+}
+
+func TestNewClientAuth(t *testing.T) {
+	if _, err := NewClientAuth(AUTH_HMAC, "", ""); err == nil {
+		t.Error("HMAC without password accepted")
+	}
+	if _, err := NewClientAuth("bogus", "", "x"); err == nil {
+		t.Error("unknown scheme accepted")
+	}
+	auth, err := NewClientAuth(AUTH_STATIC, "", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make(http.Header)
+	auth.SetHeaders(header, testPrefix, "sess")
+	if got := header.Get(testPrefix + HDR_PASSWD); got != "secret" {
+		t.Errorf("static password header %q", got)
+	}
+}
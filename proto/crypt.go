@@ -0,0 +1,78 @@
+package proto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+)
+
+const CRYPT_SALT_BYTES = 32
+
+// FrameCrypter derives per-connection AEAD keys from pre-shared key.
+// Right after hello both sides send each other random salt and
+// each direction of connection gets own key derived from PSK and both
+// salts, so frame sequence numbers can be safely used as nonces.
+type FrameCrypter struct {
+	key []byte
+}
+
+func NewFrameCrypter(psk string) *FrameCrypter {
+	key := sha256.Sum256([]byte(psk))
+	return &FrameCrypter{key: key[:]}
+}
+
+func (c *FrameCrypter) ClientHandshake(rw io.ReadWriter) (send, recv cipher.AEAD, err error) {
+	csalt, ssalt, err := exchangeSalt(rw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.deriveAEADs(csalt, ssalt, "udpierce c2s", "udpierce s2c")
+}
+
+func (c *FrameCrypter) ServerHandshake(rw io.ReadWriter) (send, recv cipher.AEAD, err error) {
+	ssalt, csalt, err := exchangeSalt(rw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.deriveAEADs(csalt, ssalt, "udpierce s2c", "udpierce c2s")
+}
+
+func exchangeSalt(rw io.ReadWriter) (own, peer []byte, err error) {
+	own = make([]byte, CRYPT_SALT_BYTES)
+	peer = make([]byte, CRYPT_SALT_BYTES)
+	if _, err = rand.Read(own); err != nil {
+		return
+	}
+	if _, err = rw.Write(own); err != nil {
+		return
+	}
+	_, err = io.ReadFull(rw, peer)
+	return
+}
+
+func (c *FrameCrypter) deriveAEADs(csalt, ssalt []byte, sendLabel, recvLabel string) (send, recv cipher.AEAD, err error) {
+	// HKDF-SHA256 with single-block expand
+	extract := hmac.New(sha256.New, append(append([]byte{}, csalt...), ssalt...))
+	extract.Write(c.key)
+	prk := extract.Sum(nil)
+	derive := func(label string) (cipher.AEAD, error) {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write([]byte(label))
+		expand.Write([]byte{1})
+		block, err := aes.NewCipher(expand.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	if send, err = derive(sendLabel); err != nil {
+		return nil, nil, err
+	}
+	if recv, err = derive(recvLabel); err != nil {
+		return nil, nil, err
+	}
+	return send, recv, nil
+}
@@ -0,0 +1,169 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"io"
+	"net"
+	"testing"
+)
+
+type handshakeResult struct {
+	send, recv cipher.AEAD
+	err        error
+}
+
+// Performs handshake of client and server with given PSKs over loopback
+// connection. Both sides write salt first, so unbuffered pipe won't do.
+func cryptPair(t *testing.T, clientPSK, serverPSK string) (client, server handshakeResult) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	done := make(chan handshakeResult)
+	go func() {
+		var r handshakeResult
+		r.send, r.recv, r.err = NewFrameCrypter(serverPSK).ServerHandshake(s)
+		done <- r
+	}()
+	client.send, client.recv, client.err = NewFrameCrypter(clientPSK).ClientHandshake(c)
+	server = <-done
+	if client.err != nil || server.err != nil {
+		t.Fatalf("handshake failed: client %v, server %v", client.err, server.err)
+	}
+	return client, server
+}
+
+func TestCrypterRoundTrip(t *testing.T) {
+	client, server := cryptPair(t, "psk", "psk")
+	for _, dir := range []struct {
+		name       string
+		send, recv cipher.AEAD
+	}{
+		{"client to server", client.send, server.recv},
+		{"server to client", server.send, client.recv},
+	} {
+		t.Run(dir.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			fw := NewFrameWriter(&stream, dir.send, nil)
+			fr := NewFrameReader(&stream, dir.recv, nil)
+			msgs := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xaa}, 1000), []byte("first")}
+			for _, m := range msgs {
+				if err := fw.WriteFrame(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Same plaintext gets different ciphertext with next sequence number
+			if bytes.Count(stream.Bytes(), []byte("first")) != 0 {
+				t.Fatal("plaintext leaked into stream")
+			}
+			for i, m := range msgs {
+				got, err := fr.ReadFrame()
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if !bytes.Equal(got, m) {
+					t.Fatalf("frame %d: got %q, want %q", i, got, m)
+				}
+			}
+		})
+	}
+}
+
+func TestCrypterDirectionsDiffer(t *testing.T) {
+	client, _ := cryptPair(t, "psk", "psk")
+	// Frame sealed for one direction must not open as another one
+	var stream bytes.Buffer
+	NewFrameWriter(&stream, client.send, nil).WriteFrame([]byte("hello"))
+	if _, err := NewFrameReader(&stream, client.recv, nil).ReadFrame(); err == nil {
+		t.Fatal("reflected frame accepted")
+	}
+}
+
+func TestCrypterWrongPSK(t *testing.T) {
+	client, server := cryptPair(t, "psk", "other")
+	var stream bytes.Buffer
+	NewFrameWriter(&stream, client.send, nil).WriteFrame([]byte("hello"))
+	if _, err := NewFrameReader(&stream, server.recv, nil).ReadFrame(); err == nil {
+		t.Fatal("frame sealed with other PSK accepted")
+	}
+}
+
+func TestCrypterFreshKeys(t *testing.T) {
+	// Salts make keys of each connection unique, so frames of one
+	// connection can't be replayed into another
+	first, _ := cryptPair(t, "psk", "psk")
+	_, second := cryptPair(t, "psk", "psk")
+	var stream bytes.Buffer
+	NewFrameWriter(&stream, first.send, nil).WriteFrame([]byte("hello"))
+	if _, err := NewFrameReader(&stream, second.recv, nil).ReadFrame(); err == nil {
+		t.Fatal("frame of other connection accepted")
+	}
+}
+
+func TestCrypterRejects(t *testing.T) {
+	client, server := cryptPair(t, "psk", "psk")
+	var stream bytes.Buffer
+	fw := NewFrameWriter(&stream, client.send, nil)
+	fw.WriteFrame([]byte("one"))
+	fw.WriteFrame([]byte("two"))
+	sealed := stream.Bytes()
+	frameLen := DGRAM_LEN_BYTES + len("one") + client.send.Overhead()
+	one, two := sealed[:frameLen], sealed[frameLen:]
+	cases := []struct {
+		name   string
+		stream func() []byte
+	}{
+		{"tampered ciphertext", func() []byte {
+			b := append([]byte(nil), one...)
+			b[DGRAM_LEN_BYTES] ^= 1
+			return b
+		}},
+		{"tampered tag", func() []byte {
+			b := append([]byte(nil), one...)
+			b[len(b)-1] ^= 1
+			return b
+		}},
+		{"reordered frames", func() []byte {
+			return append(append([]byte(nil), two...), one...)
+		}},
+		{"replayed frame", func() []byte {
+			return append(append([]byte(nil), one...), one...)
+		}},
+		{"shorter than tag", func() []byte {
+			return []byte{0, 3, 1, 2, 3}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fr := NewFrameReader(bytes.NewReader(c.stream()), server.recv, nil)
+			var err error
+			for err == nil {
+				_, err = fr.ReadFrame()
+			}
+			if err == io.EOF {
+				t.Fatal("all frames accepted")
+			}
+		})
+	}
+}
+
+func TestSeqNonce(t *testing.T) {
+	nonce := make([]byte, 12)
+	putSeqNonce(nonce, 0x0102030405060708)
+	want := []byte{0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+	if !bytes.Equal(nonce, want) {
+		t.Fatalf("got nonce %x, want %x", nonce, want)
+	}
+}
@@ -0,0 +1,225 @@
+package proto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrFrameTooLarge = errors.New("Datagram doesn't fit into frame")
+var ErrBadFrame = errors.New("Malformed frame")
+
+// FrameWriter writes datagrams into stream, each prefixed with
+// big-endian length. If AEAD is set, frame content is sealed with
+// nonce derived from frame sequence number. If padding is set, frame
+// content is type, datagram length, datagram and padding bytes.
+type FrameWriter struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	padding   *Padding
+	nonce     []byte
+	seq       uint64
+	buf       []byte
+	mux       sync.Mutex
+	lastWrite time.Time
+	coverStop chan struct{}
+	coverOnce sync.Once
+}
+
+func NewFrameWriter(w io.Writer, aead cipher.AEAD, padding *Padding) *FrameWriter {
+	fw := &FrameWriter{
+		w:       w,
+		aead:    aead,
+		padding: padding,
+		buf:     make([]byte, DGRAM_LEN_BYTES+DGRAM_BUF),
+	}
+	if aead != nil {
+		fw.nonce = make([]byte, aead.NonceSize())
+	}
+	return fw
+}
+
+// Maximal frame content size
+func (fw *FrameWriter) maxContent() int {
+	res := DGRAM_BUF - 1
+	if fw.aead != nil {
+		res -= fw.aead.Overhead()
+	}
+	return res
+}
+
+// Maximal datagram size which can be carried by single frame
+func (fw *FrameWriter) MaxPayload() int {
+	res := fw.maxContent()
+	if fw.padding != nil {
+		res -= PAD_HEADER_BYTES
+	}
+	return res
+}
+
+func (fw *FrameWriter) WriteFrame(data []byte) error {
+	if len(data) > fw.MaxPayload() {
+		return ErrFrameTooLarge
+	}
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+	return fw.writeFrame(FRAME_DATA, data)
+}
+
+func (fw *FrameWriter) writeFrame(frame_type byte, data []byte) error {
+	content := fw.buf[DGRAM_LEN_BYTES:DGRAM_LEN_BYTES]
+	if fw.padding != nil {
+		content = append(content, frame_type, 0, 0)
+		binary.BigEndian.PutUint16(content[1:], uint16(len(data)))
+		content = append(content, data...)
+		pad_len := fw.padding.padLen(len(content))
+		if room := fw.maxContent() - len(content); pad_len > room {
+			pad_len = room
+		}
+		content = content[:len(content)+pad_len]
+		zero(content[len(content)-pad_len:])
+	} else {
+		content = append(content, data...)
+	}
+	if fw.aead != nil {
+		putSeqNonce(fw.nonce, fw.seq)
+		fw.seq++
+		content = fw.aead.Seal(content[:0], fw.nonce, content, nil)
+	}
+	binary.BigEndian.PutUint16(fw.buf, uint16(len(content)))
+	_, err := fw.w.Write(fw.buf[:DGRAM_LEN_BYTES+len(content)])
+	fw.lastWrite = time.Now()
+	return err
+}
+
+// Starts sending dummy frames when stream is idle, if padding
+// configuration enables them. Stops on first write error or on
+// StopCover call.
+func (fw *FrameWriter) StartCover() {
+	if fw.padding == nil || fw.padding.cover <= 0 {
+		return
+	}
+	fw.coverStop = make(chan struct{})
+	go func() {
+		timer := time.NewTimer(fw.padding.coverDelay())
+		defer timer.Stop()
+		for {
+			select {
+			case <-fw.coverStop:
+				return
+			case <-timer.C:
+			}
+			delay := fw.padding.coverDelay()
+			fw.mux.Lock()
+			idle := time.Since(fw.lastWrite)
+			var err error
+			if idle >= delay {
+				err = fw.writeFrame(FRAME_COVER, nil)
+			} else {
+				delay -= idle
+			}
+			fw.mux.Unlock()
+			if err != nil {
+				return
+			}
+			timer.Reset(delay)
+		}
+	}()
+}
+
+func (fw *FrameWriter) StopCover() {
+	if fw.coverStop != nil {
+		fw.coverOnce.Do(func() {
+			close(fw.coverStop)
+		})
+	}
+}
+
+// FrameReader reads datagrams written by FrameWriter
+type FrameReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	padded bool
+	nonce  []byte
+	seq    uint64
+	buf    []byte
+	lenbuf []byte
+}
+
+func NewFrameReader(r io.Reader, aead cipher.AEAD, padding *Padding) *FrameReader {
+	fr := &FrameReader{
+		r:      r,
+		aead:   aead,
+		padded: padding != nil,
+		buf:    make([]byte, DGRAM_BUF),
+		lenbuf: make([]byte, DGRAM_LEN_BYTES),
+	}
+	if aead != nil {
+		fr.nonce = make([]byte, aead.NonceSize())
+	}
+	return fr
+}
+
+// Returns next datagram. Returned slice is valid until next call.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	for {
+		content, err := fr.readContent()
+		if err != nil {
+			return nil, err
+		}
+		if !fr.padded {
+			return content, nil
+		}
+		if len(content) < PAD_HEADER_BYTES {
+			return nil, ErrBadFrame
+		}
+		dgram_len := int(binary.BigEndian.Uint16(content[1:]))
+		if dgram_len > len(content)-PAD_HEADER_BYTES {
+			return nil, ErrBadFrame
+		}
+		switch content[0] {
+		case FRAME_DATA:
+			return content[PAD_HEADER_BYTES : PAD_HEADER_BYTES+dgram_len], nil
+		case FRAME_COVER:
+			continue
+		default:
+			return nil, ErrBadFrame
+		}
+	}
+}
+
+func (fr *FrameReader) readContent() ([]byte, error) {
+	_, err := io.ReadFull(fr.r, fr.lenbuf)
+	if err != nil {
+		return nil, err
+	}
+	frame_len := int(binary.BigEndian.Uint16(fr.lenbuf))
+	frame := fr.buf[:frame_len]
+	_, err = io.ReadFull(fr.r, frame)
+	if err == io.EOF {
+		// Stream ended after frame length
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fr.aead == nil {
+		return frame, nil
+	}
+	putSeqNonce(fr.nonce, fr.seq)
+	fr.seq++
+	return fr.aead.Open(frame[:0], fr.nonce, frame, nil)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func putSeqNonce(nonce []byte, seq uint64) {
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+}
@@ -0,0 +1,80 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	fw := NewFrameWriter(&stream, nil, nil)
+	fr := NewFrameReader(&stream, nil, nil)
+	msgs := [][]byte{
+		[]byte("hello"),
+		{},
+		bytes.Repeat([]byte{0x55}, fw.MaxPayload()),
+	}
+	for _, m := range msgs {
+		if err := fw.WriteFrame(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, m := range msgs {
+		got, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, m) {
+			t.Fatalf("frame %d: got %d bytes, want %d", i, len(got), len(m))
+		}
+	}
+	if _, err := fr.ReadFrame(); err != io.EOF {
+		t.Fatalf("got %v at end of stream, want EOF", err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	client, _ := cryptPair(t, "psk", "psk")
+	padding, err := NewPadding(PAD_FIXED, 512, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		fw      *FrameWriter
+		maxSize int
+	}{
+		{"plain", NewFrameWriter(ioutil.Discard, nil, nil), DGRAM_BUF - 1},
+		{"encrypted", NewFrameWriter(ioutil.Discard, client.send, nil), DGRAM_BUF - 1 - client.send.Overhead()},
+		{"padded", NewFrameWriter(ioutil.Discard, nil, padding), DGRAM_BUF - 1 - PAD_HEADER_BYTES},
+		{"encrypted and padded", NewFrameWriter(ioutil.Discard, client.send, padding),
+			DGRAM_BUF - 1 - PAD_HEADER_BYTES - client.send.Overhead()},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.fw.MaxPayload(); got != c.maxSize {
+				t.Fatalf("MaxPayload() = %d, want %d", got, c.maxSize)
+			}
+			if err := c.fw.WriteFrame(make([]byte, c.maxSize)); err != nil {
+				t.Fatalf("largest datagram rejected: %v", err)
+			}
+			if err := c.fw.WriteFrame(make([]byte, c.maxSize+1)); err != ErrFrameTooLarge {
+				t.Fatalf("got %v for oversized datagram, want ErrFrameTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestFrameTruncated(t *testing.T) {
+	var stream bytes.Buffer
+	NewFrameWriter(&stream, nil, nil).WriteFrame([]byte("hello"))
+	full := stream.Bytes()
+	for _, n := range []int{1, DGRAM_LEN_BYTES, len(full) - 1} {
+		fr := NewFrameReader(bytes.NewReader(full[:n]), nil, nil)
+		if _, err := fr.ReadFrame(); err != io.ErrUnexpectedEOF {
+			t.Errorf("%d of %d bytes: got %v, want ErrUnexpectedEOF", n, len(full), err)
+		}
+	}
+}
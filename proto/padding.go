@@ -0,0 +1,76 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	PAD_NONE    = "none"
+	PAD_UNIFORM = "uniform"
+	PAD_EXP     = "exp"
+	PAD_FIXED   = "fixed"
+)
+
+const (
+	FRAME_DATA  = 0
+	FRAME_COVER = 1
+)
+
+// Padded frame content is type byte, datagram length, datagram and padding
+const PAD_HEADER_BYTES = 1 + DGRAM_LEN_BYTES
+
+// Padding describes length obfuscation of frames. Non-nil padding
+// changes frame format, so both sides have to agree on it.
+type Padding struct {
+	mode  string
+	size  int
+	cover time.Duration
+}
+
+func NewPadding(mode string, size int, cover time.Duration) (*Padding, error) {
+	switch mode {
+	case PAD_NONE:
+		if cover > 0 {
+			return nil, errors.New("Cover frames require padding mode other than " + PAD_NONE)
+		}
+		return nil, nil
+	case PAD_UNIFORM, PAD_EXP, PAD_FIXED:
+	default:
+		return nil, fmt.Errorf("Unknown padding mode %q", mode)
+	}
+	if size < 1 || size > DGRAM_BUF-1 {
+		return nil, errors.New("Bad padding size")
+	}
+	return &Padding{
+		mode:  mode,
+		size:  size,
+		cover: cover,
+	}, nil
+}
+
+// Returns amount of padding bytes for frame content of given length
+func (p *Padding) padLen(content_len int) int {
+	switch p.mode {
+	case PAD_UNIFORM:
+		return rand.Intn(p.size + 1)
+	case PAD_EXP:
+		l := rand.ExpFloat64() * float64(p.size)
+		if l > math.MaxUint16 {
+			return math.MaxUint16
+		}
+		return int(l)
+	case PAD_FIXED:
+		// Round up to record size
+		return (p.size - content_len%p.size) % p.size
+	}
+	return 0
+}
+
+// Returns randomized delay before next cover frame
+func (p *Padding) coverDelay() time.Duration {
+	return p.cover/2 + time.Duration(rand.Int63n(int64(p.cover)))
+}
@@ -0,0 +1,190 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNewPadding(t *testing.T) {
+	cases := []struct {
+		mode    string
+		size    int
+		cover   time.Duration
+		wantNil bool
+		wantErr bool
+	}{
+		{mode: PAD_NONE, wantNil: true},
+		{mode: PAD_NONE, cover: time.Second, wantErr: true},
+		{mode: PAD_UNIFORM, size: 256},
+		{mode: PAD_EXP, size: 64, cover: time.Second},
+		{mode: PAD_FIXED, size: DGRAM_BUF - 1},
+		{mode: PAD_FIXED, size: 0, wantErr: true},
+		{mode: PAD_FIXED, size: DGRAM_BUF, wantErr: true},
+		{mode: "bogus", size: 1, wantErr: true},
+	}
+	for _, c := range cases {
+		p, err := NewPadding(c.mode, c.size, c.cover)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s/%d/%v: got error %v, want error %v", c.mode, c.size, c.cover, err, c.wantErr)
+			continue
+		}
+		if err == nil && (p == nil) != c.wantNil {
+			t.Errorf("%s/%d/%v: got padding %v", c.mode, c.size, c.cover, p)
+		}
+	}
+}
+
+func TestPadLen(t *testing.T) {
+	cases := []struct {
+		mode string
+		size int
+		// Bounds of content length plus padding
+		check func(content, pad int) bool
+	}{
+		{PAD_UNIFORM, 100, func(content, pad int) bool { return pad >= 0 && pad <= 100 }},
+		{PAD_EXP, 100, func(content, pad int) bool { return pad >= 0 && pad <= 65535 }},
+		{PAD_FIXED, 100, func(content, pad int) bool { return pad < 100 && (content+pad)%100 == 0 }},
+		{PAD_FIXED, 1, func(content, pad int) bool { return pad == 0 }},
+	}
+	for _, c := range cases {
+		p, err := NewPadding(c.mode, c.size, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for content := 0; content < 1000; content++ {
+			if pad := p.padLen(content); !c.check(content, pad) {
+				t.Fatalf("%s/%d: padding %d for content %d", c.mode, c.size, pad, content)
+			}
+		}
+	}
+}
+
+func TestPaddedRoundTrip(t *testing.T) {
+	client, server := cryptPair(t, "psk", "psk")
+	for _, mode := range []string{PAD_UNIFORM, PAD_EXP, PAD_FIXED} {
+		for _, encrypted := range []bool{false, true} {
+			p, err := NewPadding(mode, 300, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stream bytes.Buffer
+			fw := NewFrameWriter(&stream, nil, p)
+			fr := NewFrameReader(&stream, nil, p)
+			if encrypted {
+				fw = NewFrameWriter(&stream, client.send, p)
+				fr = NewFrameReader(&stream, server.recv, p)
+			}
+			msgs := [][]byte{
+				[]byte("hello"),
+				{},
+				bytes.Repeat([]byte{0x55}, fw.MaxPayload()),
+				[]byte("bye"),
+			}
+			for i, m := range msgs {
+				if err := fw.WriteFrame(m); err != nil {
+					t.Fatal(err)
+				}
+				// Cover frames between data frames are skipped by reader
+				if i%2 == 0 {
+					if err := fw.writeFrame(FRAME_COVER, nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for i, m := range msgs {
+				got, err := fr.ReadFrame()
+				if err != nil {
+					t.Fatalf("%s, encrypted %v, frame %d: %v", mode, encrypted, i, err)
+				}
+				if !bytes.Equal(got, m) {
+					t.Fatalf("%s, encrypted %v, frame %d: got %d bytes, want %d",
+						mode, encrypted, i, len(got), len(m))
+				}
+			}
+			if _, err := fr.ReadFrame(); err != io.EOF {
+				t.Fatalf("%s, encrypted %v: got %v at end of stream, want EOF", mode, encrypted, err)
+			}
+		}
+	}
+}
+
+func TestFixedPaddingFrameSize(t *testing.T) {
+	p, _ := NewPadding(PAD_FIXED, 128, 0)
+	for _, size := range []int{0, 1, 124, 125, 126, 1000} {
+		var stream bytes.Buffer
+		NewFrameWriter(&stream, nil, p).WriteFrame(make([]byte, size))
+		if content := stream.Len() - DGRAM_LEN_BYTES; content%128 != 0 {
+			t.Errorf("datagram of %d bytes: frame content %d isn't multiple of 128", size, content)
+		}
+	}
+}
+
+func TestPaddedRejects(t *testing.T) {
+	p, _ := NewPadding(PAD_UNIFORM, 16, 0)
+	frame := func(content ...byte) []byte {
+		b := make([]byte, DGRAM_LEN_BYTES, DGRAM_LEN_BYTES+len(content))
+		binary.BigEndian.PutUint16(b, uint16(len(content)))
+		return append(b, content...)
+	}
+	cases := []struct {
+		name   string
+		stream []byte
+	}{
+		{"empty content", frame()},
+		{"short header", frame(FRAME_DATA, 0)},
+		{"length beyond content", frame(FRAME_DATA, 0, 4, 'a', 'b', 'c')},
+		{"unknown type", frame(7, 0, 1, 'a')},
+		{"bad frame after cover", append(frame(FRAME_COVER, 0, 0), frame(FRAME_DATA, 0xff, 0xff)...)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewFrameReader(bytes.NewReader(c.stream), nil, p).ReadFrame()
+			if err != ErrBadFrame {
+				t.Fatalf("got %v, want ErrBadFrame", err)
+			}
+		})
+	}
+}
+
+// Counts bytes passing through
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
+
+func TestCoverFrames(t *testing.T) {
+	p, err := NewPadding(PAD_FIXED, 64, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	fw := NewFrameWriter(pw, nil, p)
+	fw.StartCover()
+	defer fw.StopCover()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		fw.WriteFrame([]byte("data"))
+	}()
+	cr := &countingReader{r: pr}
+	got, err := NewFrameReader(cr, nil, p).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "data" {
+		t.Fatalf("got %q, want \"data\"", got)
+	}
+	// Data frame is single 64 byte record, rest are cover frames
+	if covers := (cr.n - DGRAM_LEN_BYTES - 64) / (DGRAM_LEN_BYTES + 64); covers < 2 {
+		t.Fatalf("%d cover frames sent while idle", covers)
+	}
+}
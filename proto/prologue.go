@@ -0,0 +1,156 @@
+package proto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_METHOD        = "CONNECT"
+	DEFAULT_PATH          = "/"
+	DEFAULT_HEADER_PREFIX = "X-UDPIERCE-"
+	DEFAULT_HELLO_STATUS  = "200 OK"
+)
+
+// Protocol header name suffixes
+const (
+	HDR_SESSION = "SESSION"
+	HDR_PASSWD  = "PASSWD"
+	HDR_USER    = "USER"
+	HDR_TIME    = "TIME"
+	HDR_NONCE   = "NONCE"
+	HDR_AUTH    = "AUTH"
+	HDR_ADDRESS = "ADDRESS"
+	HDR_DEST    = "DESTINATION"
+)
+
+// RequestTemplate describes HTTP request which opens upstream connection
+type RequestTemplate struct {
+	method string
+	path   string
+	host   string
+	prefix string
+	extra  http.Header
+}
+
+func NewRequestTemplate(method, path, host, prefix string, extra http.Header) *RequestTemplate {
+	return &RequestTemplate{
+		method: method,
+		path:   path,
+		host:   host,
+		prefix: prefix,
+		extra:  extra,
+	}
+}
+
+// Returns template of plain CONNECT request with default headers
+func DefaultRequestTemplate() *RequestTemplate {
+	return NewRequestTemplate(DEFAULT_METHOD, DEFAULT_PATH, "", DEFAULT_HEADER_PREFIX, nil)
+}
+
+// Name prefix of protocol headers
+func (t *RequestTemplate) Prefix() string {
+	return t.prefix
+}
+
+// Builds connection request. Header holds additional per-session
+// headers and may be nil.
+func (t *RequestTemplate) Build(sess_id string, auth *ClientAuth, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(t.method, t.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = t.host
+	for name, values := range t.extra {
+		req.Header[name] = values
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	err = auth.SetHeaders(req.Header, t.prefix, sess_id)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(t.prefix+HDR_SESSION, sess_id)
+	return httputil.DumpRequest(req, false)
+}
+
+// Checks if incoming request matches method and path of template
+func (t *RequestTemplate) Matches(req *http.Request) bool {
+	return strings.EqualFold(req.Method, t.method) && req.URL.Path == t.path
+}
+
+// Reads server hello and returns its headers. Any successful status
+// is accepted.
+func ReadHello(br *bufio.Reader) (http.Header, error) {
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.New("Bad hello from server: " + resp.Status)
+	}
+	return resp.Header, nil
+}
+
+// ResponseTemplate describes server hello
+type ResponseTemplate struct {
+	status string
+	header http.Header
+	date   bool
+}
+
+// Status has to be successful, since client accepts only 2xx hello
+func NewResponseTemplate(status string, header http.Header, date bool) (*ResponseTemplate, error) {
+	code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	if err != nil || code < 100 || code > 999 {
+		return nil, fmt.Errorf("Bad HTTP status %q: expected code and reason phrase", status)
+	}
+	if code < 200 || code > 299 {
+		return nil, fmt.Errorf("Bad HTTP status %q: client accepts only 2xx status", status)
+	}
+	return &ResponseTemplate{
+		status: status,
+		header: header,
+		date:   date,
+	}, nil
+}
+
+// Returns template of bare "200 OK" response
+func DefaultResponseTemplate() *ResponseTemplate {
+	return &ResponseTemplate{status: DEFAULT_HELLO_STATUS}
+}
+
+func (t *ResponseTemplate) Hello() []byte {
+	return t.HelloWith(nil)
+}
+
+// Returns hello with additional per-session headers
+func (t *ResponseTemplate) HelloWith(extra http.Header) []byte {
+	var sb strings.Builder
+	sb.WriteString("HTTP/1.1 ")
+	sb.WriteString(t.status)
+	sb.WriteString("\r\n")
+	header := t.header
+	if t.date || len(extra) > 0 {
+		header = make(http.Header)
+		for name, values := range t.header {
+			header[name] = values
+		}
+		for name, values := range extra {
+			header[name] = values
+		}
+	}
+	if t.date {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	header.Write(&sb)
+	sb.WriteString("\r\n")
+	return []byte(sb.String())
+}
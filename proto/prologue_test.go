@@ -0,0 +1,37 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestResponseTemplateStatus(t *testing.T) {
+	cases := []struct {
+		status  string
+		wantErr bool
+	}{
+		{"200 OK", false},
+		{"201 Created", false},
+		{"299 Whatever", false},
+		{"101 Switching Protocols", true},
+		{"302 Found", true},
+		{"404 Not Found", true},
+		{"OK", true},
+		{"", true},
+	}
+	for _, c := range cases {
+		tmpl, err := NewResponseTemplate(c.status, nil, false)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%q: got error %v, want error %t", c.status, err, c.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		// Every accepted status makes hello client accepts
+		if _, err := ReadHello(bufio.NewReader(bytes.NewReader(tmpl.Hello()))); err != nil {
+			t.Errorf("%q: client rejects hello: %v", c.status, err)
+		}
+	}
+}
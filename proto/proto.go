@@ -0,0 +1,25 @@
+// Package proto implements udpierce wire protocol parts shared by client
+// and server: connection request and hello, authentication tokens and
+// datagram framing.
+package proto
+
+const DGRAM_BUF = int(^uint16(0)) + 1
+const DGRAM_LEN_BYTES = 2
+
+// Logger is a leveled logger used by udpierce components
+type Logger interface {
+	Critical(format string, v ...interface{}) error
+	Error(format string, v ...interface{}) error
+	Warning(format string, v ...interface{}) error
+	Info(format string, v ...interface{}) error
+	Debug(format string, v ...interface{}) error
+}
+
+// NopLogger discards all messages
+type NopLogger struct{}
+
+func (NopLogger) Critical(string, ...interface{}) error { return nil }
+func (NopLogger) Error(string, ...interface{}) error    { return nil }
+func (NopLogger) Warning(string, ...interface{}) error  { return nil }
+func (NopLogger) Info(string, ...interface{}) error     { return nil }
+func (NopLogger) Debug(string, ...interface{}) error    { return nil }
@@ -0,0 +1,49 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Time to wait for connection to probed socket
+const socketProbeTimeout = time.Second
+
+// Removes stale unix socket file left at path by previous run, so it
+// can be bound again. Socket is considered stale if connection to it
+// with given network ("unix" or "unixgram") is refused. Socket in use
+// is reported as error. Files of other types and sockets which can't
+// be probed are left intact.
+func RemoveStaleSocket(network, path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout(network, path, socketProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("Socket %s is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// Sets permissions of bound unix socket file. Zero mode leaves
+// permissions defined by umask.
+func ChmodSocket(path string, mode os.FileMode) error {
+	if mode == 0 {
+		return nil
+	}
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,79 @@
+package proto
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Binds socket of given network at path
+func bindSocket(t *testing.T, network, path string) interface{ Close() error } {
+	addr := &net.UnixAddr{Name: path, Net: network}
+	if network == "unixgram" {
+		conn, err := net.ListenUnixgram(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	ln, err := net.ListenUnix(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closed socket file is left behind, like after crash
+	ln.SetUnlinkOnClose(false)
+	return ln
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, network := range []string{"unix", "unixgram"} {
+		path := filepath.Join(dir, network+".sock")
+		sock := bindSocket(t, network, path)
+		if err := RemoveStaleSocket(network, path); err == nil {
+			t.Errorf("%s: socket in use isn't reported", network)
+		}
+		if !exists(path) {
+			t.Fatalf("%s: socket in use removed", network)
+		}
+		sock.Close()
+		if err := RemoveStaleSocket(network, path); err != nil {
+			t.Errorf("%s: %v", network, err)
+		}
+		if exists(path) {
+			t.Errorf("%s: stale socket isn't removed", network)
+		}
+	}
+
+	// Socket of other type isn't touched, bind reports it
+	path := filepath.Join(dir, "other.sock")
+	sock := bindSocket(t, "unix", path)
+	defer sock.Close()
+	if err := RemoveStaleSocket("unixgram", path); err != nil || !exists(path) {
+		t.Errorf("socket of other type: got %v, exists %t", err, exists(path))
+	}
+
+	// Regular file and missing file
+	path = filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveStaleSocket("unix", path); err != nil || !exists(path) {
+		t.Errorf("regular file: got %v, exists %t", err, exists(path))
+	}
+	if err := RemoveStaleSocket("unix", filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+}
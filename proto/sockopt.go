@@ -0,0 +1,59 @@
+package proto
+
+import (
+	"net"
+	"syscall"
+)
+
+// SocketOptions describe setup of outgoing sockets, so policy routing
+// can tell udpierce traffic apart. Zero fields leave system defaults.
+type SocketOptions struct {
+	// Local address of outgoing connections
+	SourceAddr net.IP
+	// Network interface to bind sockets to (SO_BINDTODEVICE). Linux only.
+	Interface string
+	// Firewall mark of sockets (SO_MARK). Linux only.
+	Mark int
+	// Differentiated services code point of outgoing packets, 0-63.
+	// Linux only.
+	DSCP int
+}
+
+// Returns dialer for given network ("tcp" or "udp") which applies
+// options to its sockets. Nil options give plain dialer.
+func (o *SocketOptions) Dialer(network string) *net.Dialer {
+	var dialer net.Dialer
+	if o == nil {
+		return &dialer
+	}
+	if o.SourceAddr != nil {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			dialer.LocalAddr = &net.TCPAddr{IP: o.SourceAddr}
+		case "udp", "udp4", "udp6":
+			dialer.LocalAddr = &net.UDPAddr{IP: o.SourceAddr}
+		}
+	}
+	if o.Interface != "" || o.Mark != 0 || o.DSCP != 0 {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = o.setSockopts(fd, network)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	return &dialer
+}
+
+// Reports whether address can be reached from source address, i.e.
+// they belong to same address family
+func (o *SocketOptions) Reachable(ip net.IP) bool {
+	if o == nil || o.SourceAddr == nil {
+		return true
+	}
+	return (o.SourceAddr.To4() != nil) == (ip.To4() != nil)
+}
@@ -0,0 +1,38 @@
+package proto
+
+import (
+	"syscall"
+)
+
+func (o *SocketOptions) setSockopts(fd uintptr, network string) error {
+	if o.Interface != "" {
+		if err := syscall.BindToDevice(int(fd), o.Interface); err != nil {
+			return err
+		}
+	}
+	if o.Mark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark); err != nil {
+			return err
+		}
+	}
+	if o.DSCP != 0 {
+		tos := o.DSCP << 2
+		switch network {
+		case "tcp6", "udp6":
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos); err != nil {
+				return err
+			}
+			// Dual-stack socket may also send IPv4 packets. Option
+			// unsupported by socket means it can't.
+			err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			if err != nil && err != syscall.ENOPROTOOPT {
+				return err
+			}
+		default:
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package proto
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestDSCP(t *testing.T) {
+	opts := &SocketOptions{DSCP: 46}
+	cases := []struct {
+		address     string
+		level, name int
+	}{
+		{"127.0.0.1:9", syscall.IPPROTO_IP, syscall.IP_TOS},
+		{"[::1]:9", syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS},
+	}
+	for _, c := range cases {
+		conn, err := opts.Dialer("udp").Dial("udp", c.address)
+		if err != nil {
+			t.Logf("%s: %v", c.address, err)
+			continue
+		}
+		raw, err := conn.(*net.UDPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tos int
+		var serr error
+		raw.Control(func(fd uintptr) {
+			tos, serr = syscall.GetsockoptInt(int(fd), c.level, c.name)
+		})
+		conn.Close()
+		if serr != nil {
+			t.Fatalf("%s: %v", c.address, serr)
+		}
+		if tos != 46<<2 {
+			t.Errorf("%s: got traffic class %#x, want %#x", c.address, tos, 46<<2)
+		}
+	}
+}
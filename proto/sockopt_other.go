@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package proto
+
+import (
+	"errors"
+)
+
+func (o *SocketOptions) setSockopts(fd uintptr, network string) error {
+	return errors.New("interface binding, firewall mark and DSCP are supported only on Linux")
+}
@@ -0,0 +1,156 @@
+package proto
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TLSParams holds tunable handshake parameters shared by client and
+// server. Zero fields leave crypto/tls defaults.
+type TLSParams struct {
+	// Application protocols offered by client or accepted by server
+	ALPN []string
+	// TLS 1.0-1.2 cipher suites. TLS 1.3 suites are not configurable.
+	// crypto/tls picks order of suites and curves on its own.
+	CipherSuites []uint16
+	Curves       []tls.CurveID
+	MinVersion   uint16
+	MaxVersion   uint16
+}
+
+// Sets non-zero parameters in config
+func (p *TLSParams) Apply(cfg *tls.Config) {
+	if p == nil {
+		return
+	}
+	if len(p.ALPN) > 0 {
+		cfg.NextProtos = p.ALPN
+	}
+	if len(p.CipherSuites) > 0 {
+		cfg.CipherSuites = p.CipherSuites
+	}
+	if len(p.Curves) > 0 {
+		cfg.CurvePreferences = p.Curves
+	}
+	if p.MinVersion != 0 {
+		cfg.MinVersion = p.MinVersion
+	}
+	if p.MaxVersion != 0 {
+		cfg.MaxVersion = p.MaxVersion
+	}
+}
+
+// Returns copy of p with non-zero parameters of other put over it
+func (p *TLSParams) Merge(other *TLSParams) *TLSParams {
+	var res TLSParams
+	if p != nil {
+		res = *p
+	}
+	if other == nil {
+		return &res
+	}
+	if len(other.ALPN) > 0 {
+		res.ALPN = other.ALPN
+	}
+	if len(other.CipherSuites) > 0 {
+		res.CipherSuites = other.CipherSuites
+	}
+	if len(other.Curves) > 0 {
+		res.Curves = other.Curves
+	}
+	if other.MinVersion != 0 {
+		res.MinVersion = other.MinVersion
+	}
+	if other.MaxVersion != 0 {
+		res.MaxVersion = other.MaxVersion
+	}
+	return &res
+}
+
+// Parses comma-separated list of items. Empty string gives nil.
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// Parses comma-separated list of ALPN protocol names
+func ParseALPN(s string) []string {
+	return splitList(s)
+}
+
+// Parses comma-separated list of cipher suite names as used by
+// crypto/tls, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, or
+// hexadecimal IDs like 0xc02f
+func ParseCipherSuites(s string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	// Names of crypto/tls constants
+	known["TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305"] = tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305
+	known["TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305"] = tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305
+	var res []uint16
+	for _, name := range splitList(s) {
+		if id, ok := known[name]; ok {
+			res = append(res, id)
+			continue
+		}
+		id, err := strconv.ParseUint(name, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown cipher suite %q", name)
+		}
+		res = append(res, uint16(id))
+	}
+	return res, nil
+}
+
+// Parses comma-separated list of curve names (X25519, P256, P384,
+// P521) or numeric group IDs
+func ParseCurves(s string) ([]tls.CurveID, error) {
+	known := map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+	var res []tls.CurveID
+	for _, name := range splitList(s) {
+		if id, ok := known[strings.ToUpper(strings.Replace(name, "-", "", -1))]; ok {
+			res = append(res, id)
+			continue
+		}
+		id, err := strconv.ParseUint(name, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown curve %q", name)
+		}
+		res = append(res, tls.CurveID(id))
+	}
+	return res, nil
+}
+
+// Parses TLS version like "1.2". Empty string gives zero.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Unknown TLS version %q: expected one of 1.0, 1.1, 1.2, 1.3", s)
+}
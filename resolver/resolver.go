@@ -0,0 +1,196 @@
+// Package resolver implements hostname resolution through DNS-over-HTTPS,
+// DNS-over-TLS or plain DNS servers with static host overrides and
+// cache respecting record TTL
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/Snawoot/udpierce/proto"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout of query to single server
+const DEFAULT_TIMEOUT = 5 * time.Second
+
+// Bounds of time for which answers are cached. System resolver
+// answers carry no TTL and are cached for DEFAULT_MIN_TTL.
+const (
+	DEFAULT_MIN_TTL = 10 * time.Second
+	DEFAULT_MAX_TTL = time.Hour
+)
+
+type Options struct {
+	// DNS servers tried in order: "udp://HOST[:PORT]" or just
+	// "HOST[:PORT]" for plain DNS, "tls://HOST[:PORT]" for DNS-over-TLS
+	// and "https://HOST[:PORT]/PATH" for DNS-over-HTTPS. Empty list means
+	// system resolver.
+	Servers []string
+	// Static addresses of hostnames. Take precedence over servers and
+	// are also used to resolve hostnames of servers themselves.
+	Hosts map[string][]net.IP
+	// Query timeout of single server. Defaults to DEFAULT_TIMEOUT.
+	Timeout time.Duration
+	// Bounds of answer cache time. Default to DEFAULT_MIN_TTL and
+	// DEFAULT_MAX_TTL.
+	MinTTL, MaxTTL time.Duration
+	// Setup of sockets connected to DNS servers, optional
+	SocketOptions *proto.SocketOptions
+	Logger        proto.Logger
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Resolver looks up hostnames with static hosts, cache and DNS servers,
+// in that order. Cached addresses are kept after expiration and used
+// if servers fail to answer.
+type Resolver struct {
+	servers  []server
+	hosts    map[string][]net.IP
+	timeout  time.Duration
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	cache    map[string]*cacheEntry
+	mux      sync.Mutex
+	sockopts *proto.SocketOptions
+	logger   proto.Logger
+}
+
+func New(opts Options) (*Resolver, error) {
+	r := &Resolver{
+		hosts:    make(map[string][]net.IP),
+		timeout:  opts.Timeout,
+		minTTL:   opts.MinTTL,
+		maxTTL:   opts.MaxTTL,
+		cache:    make(map[string]*cacheEntry),
+		sockopts: opts.SocketOptions,
+		logger:   opts.Logger,
+	}
+	if r.timeout <= 0 {
+		r.timeout = DEFAULT_TIMEOUT
+	}
+	if r.minTTL <= 0 {
+		r.minTTL = DEFAULT_MIN_TTL
+	}
+	if r.maxTTL <= 0 {
+		r.maxTTL = DEFAULT_MAX_TTL
+	}
+	if r.maxTTL < r.minTTL {
+		return nil, fmt.Errorf("maximal TTL %v is less than minimal TTL %v", r.maxTTL, r.minTTL)
+	}
+	if r.logger == nil {
+		r.logger = proto.NopLogger{}
+	}
+	for name, ips := range opts.Hosts {
+		r.hosts[canonicalName(name)] = ips
+	}
+	for _, spec := range opts.Servers {
+		srv, err := parseServer(spec, r.dialContext)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, srv)
+	}
+	return r, nil
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Resolves all IPv4 and IPv6 addresses of host. IP literals are
+// returned as is.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := canonicalName(host)
+	if ips, ok := r.hosts[name]; ok {
+		return ips, nil
+	}
+	r.mux.Lock()
+	entry := r.cache[name]
+	r.mux.Unlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+	ips, ttl, err := r.query(ctx, name)
+	if err != nil {
+		if entry != nil {
+			r.logger.Warning("Lookup of %s failed, using stale addresses: %v", host, err)
+			return entry.ips, nil
+		}
+		return nil, err
+	}
+	if ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	if ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	r.logger.Debug("Resolved %s to %v, cached for %v", host, ips, ttl)
+	r.mux.Lock()
+	r.cache[name] = &cacheEntry{ips, time.Now().Add(ttl)}
+	r.mux.Unlock()
+	return ips, nil
+}
+
+func (r *Resolver) query(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if len(r.servers) == 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+		return ips, 0, nil
+	}
+	var lastErr error
+	for _, srv := range r.servers {
+		qctx, cancel := context.WithTimeout(ctx, r.timeout)
+		ips, ttl, err := lookup(qctx, srv, name)
+		cancel()
+		if err == nil {
+			return ips, ttl, nil
+		}
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, 0, err
+		}
+		r.logger.Debug("Lookup of %s with %s failed: %v", name, srv, err)
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// Connects to DNS server with configured socket options. Server
+// hostname is resolved with static hosts or system resolver.
+func (r *Resolver) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := r.sockopts.Dialer(network)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, ok := r.hosts[canonicalName(host)]
+	if !ok {
+		return dialer.DialContext(ctx, network, address)
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,235 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Answers queries with configured records or error and counts them
+type fakeServer struct {
+	t       *testing.T
+	mux     sync.Mutex
+	answers []testRR
+	rcode   dnsmessage.RCode
+	err     error
+	queries int
+}
+
+func (s *fakeServer) String() string {
+	return "fake"
+}
+
+func (s *fakeServer) set(rcode dnsmessage.RCode, err error, answers ...testRR) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.rcode, s.err, s.answers = rcode, err, answers
+}
+
+func (s *fakeServer) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.queries
+}
+
+func (s *fakeServer) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.queries++
+	if s.err != nil {
+		return nil, s.err
+	}
+	var answers []testRR
+	for _, rr := range s.answers {
+		isV4 := net.ParseIP(rr.a).To4() != nil
+		if rr.cname != "" || isV4 == (q.Type == dnsmessage.TypeA) {
+			answers = append(answers, rr)
+		}
+	}
+	return buildAnswer(s.t, h.ID, s.rcode, false, true, q.Name.String(), q.Type, answers...), nil
+}
+
+func newTestResolver(t *testing.T, opts Options, servers ...server) *Resolver {
+	r, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.servers = servers
+	return r
+}
+
+func lookupString(r *Resolver, host string) (string, error) {
+	ips, err := r.LookupIP(context.Background(), host)
+	var s []string
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return strings.Join(s, ","), err
+}
+
+// Moves cache entry expiration to past
+func expire(r *Resolver, name string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.cache[name].expires = time.Now().Add(-time.Second)
+}
+
+func cachedFor(r *Resolver, name string) time.Duration {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return time.Until(r.cache[name].expires)
+}
+
+func TestLookupCache(t *testing.T) {
+	const q = "www.example.com."
+	srv := &fakeServer{t: t}
+	srv.set(dnsmessage.RCodeSuccess, nil,
+		testRR{name: q, ttl: 300, a: "192.0.2.1"},
+		testRR{name: q, ttl: 300, a: "2001:db8::1"})
+	r := newTestResolver(t, Options{MinTTL: time.Minute, MaxTTL: time.Hour}, srv)
+
+	got, err := lookupString(r, "WWW.Example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "192.0.2.1,2001:db8::1" && got != "2001:db8::1,192.0.2.1" {
+		t.Fatalf("got %s", got)
+	}
+	if n := srv.count(); n != 2 {
+		t.Fatalf("%d queries made, want A and AAAA", n)
+	}
+	if d := cachedFor(r, "www.example.com"); d < 299*time.Second || d > 300*time.Second {
+		t.Fatalf("cached for %v, want record TTL", d)
+	}
+
+	// Fresh entry is served from cache
+	if _, err := lookupString(r, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.count(); n != 2 {
+		t.Fatalf("%d queries made, want cache hit", n)
+	}
+
+	// Expired entry is refreshed
+	expire(r, "www.example.com")
+	srv.set(dnsmessage.RCodeSuccess, nil, testRR{name: q, ttl: 300, a: "192.0.2.2"})
+	if got, _ := lookupString(r, "www.example.com"); got != "192.0.2.2" {
+		t.Fatalf("got %s after expiration, want new address", got)
+	}
+
+	// Expired entry is used if server fails
+	expire(r, "www.example.com")
+	srv.set(dnsmessage.RCodeSuccess, errors.New("i/o timeout"))
+	if got, err := lookupString(r, "www.example.com"); err != nil || got != "192.0.2.2" {
+		t.Fatalf("got %s, %v on server failure, want stale address", got, err)
+	}
+
+	// Name without addresses is reported as not found
+	srv.set(dnsmessage.RCodeSuccess, nil)
+	if _, err := lookupString(r, "nothing.example.com"); err == nil {
+		t.Fatal("lookup of name without addresses succeeded")
+	}
+}
+
+func TestLookupTTLBounds(t *testing.T) {
+	const q = "www.example.com."
+	cases := []struct {
+		name string
+		ttl  uint32
+		want time.Duration
+	}{
+		{"zero TTL", 0, time.Minute},
+		{"short TTL", 5, time.Minute},
+		{"TTL within bounds", 600, 10 * time.Minute},
+		{"long TTL", 86400, time.Hour},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := &fakeServer{t: t}
+			srv.set(dnsmessage.RCodeSuccess, nil, testRR{name: q, ttl: c.ttl, a: "192.0.2.1"})
+			r := newTestResolver(t, Options{MinTTL: time.Minute, MaxTTL: time.Hour}, srv)
+			if _, err := lookupString(r, "www.example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if d := cachedFor(r, "www.example.com"); d < c.want-time.Second || d > c.want {
+				t.Fatalf("cached for %v, want %v", d, c.want)
+			}
+		})
+	}
+}
+
+func TestLookupServerOrder(t *testing.T) {
+	const q = "www.example.com."
+	failing := &fakeServer{t: t}
+	failing.set(dnsmessage.RCodeSuccess, errors.New("connection refused"))
+	broken := &fakeServer{t: t}
+	broken.set(dnsmessage.RCodeServerFailure, nil)
+	good := &fakeServer{t: t}
+	good.set(dnsmessage.RCodeSuccess, nil, testRR{name: q, ttl: 60, a: "192.0.2.1"})
+
+	r := newTestResolver(t, Options{}, failing, broken, good)
+	if got, err := lookupString(r, "www.example.com"); err != nil || got != "192.0.2.1" {
+		t.Fatalf("got %s, %v; want answer of third server", got, err)
+	}
+
+	// NXDOMAIN is final answer, other servers aren't asked
+	nx := &fakeServer{t: t}
+	nx.set(dnsmessage.RCodeNameError, nil)
+	other := &fakeServer{t: t}
+	other.set(dnsmessage.RCodeSuccess, nil, testRR{name: q, ttl: 60, a: "192.0.2.1"})
+	r = newTestResolver(t, Options{}, nx, other)
+	_, err := lookupString(r, "www.example.com")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Fatalf("got %v, want not found error", err)
+	}
+	if n := other.count(); n != 0 {
+		t.Fatalf("next server asked %d times after NXDOMAIN", n)
+	}
+}
+
+func TestLookupStatic(t *testing.T) {
+	srv := &fakeServer{t: t}
+	srv.set(dnsmessage.RCodeSuccess, errors.New("must not be asked"))
+	r := newTestResolver(t, Options{
+		Hosts: map[string][]net.IP{"Static.Example.": {net.ParseIP("192.0.2.9")}},
+	}, srv)
+	cases := []struct {
+		host, want string
+	}{
+		{"static.example", "192.0.2.9"},
+		{"STATIC.EXAMPLE.", "192.0.2.9"},
+		{"192.0.2.77", "192.0.2.77"},
+		{"2001:db8::77", "2001:db8::77"},
+	}
+	for _, c := range cases {
+		if got, err := lookupString(r, c.host); err != nil || got != c.want {
+			t.Errorf("%s: got %s, %v; want %s", c.host, got, err, c.want)
+		}
+	}
+	if n := srv.count(); n != 0 {
+		t.Fatalf("server asked %d times", n)
+	}
+}
+
+func TestNewTTLBounds(t *testing.T) {
+	if _, err := New(Options{MinTTL: time.Hour, MaxTTL: time.Minute}); err == nil {
+		t.Fatal("maximal TTL below minimal accepted")
+	}
+	if _, err := New(Options{Servers: []string{"bogus://x"}}); err == nil {
+		t.Fatal("unknown server scheme accepted")
+	}
+}
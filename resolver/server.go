@@ -0,0 +1,380 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DNS server schemes
+const (
+	SCHEME_UDP   = "udp"
+	SCHEME_TLS   = "tls"
+	SCHEME_HTTPS = "https"
+)
+
+// Largest DNS message
+const maxMessageSize = 65535
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// server sends DNS query and returns response
+type server interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// Parses DNS server specification, see Options.Servers. Connections to
+// server are made with given dial function.
+func parseServer(spec string, dial dialFunc) (server, error) {
+	scheme, rest := SCHEME_UDP, spec
+	if idx := strings.Index(spec, "://"); idx >= 0 {
+		scheme, rest = spec[:idx], spec[idx+3:]
+	}
+	switch scheme {
+	case SCHEME_UDP:
+		return &udpServer{withPort(rest, "53"), dial}, nil
+	case SCHEME_TLS:
+		addr := withPort(rest, "853")
+		host, _, _ := net.SplitHostPort(addr)
+		return &tlsServer{addr, &tls.Config{ServerName: host}, dial}, nil
+	case SCHEME_HTTPS:
+		return &httpsServer{spec, &http.Client{
+			Transport: &http.Transport{
+				DialContext:       dial,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		}}, nil
+	}
+	return nil, fmt.Errorf("unknown DNS server scheme %q", scheme)
+}
+
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+type udpServer struct {
+	addr string
+	dial dialFunc
+}
+
+func (s *udpServer) String() string {
+	return SCHEME_UDP + "://" + s.addr
+}
+
+func (s *udpServer) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := s.dial(ctx, "udp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams with other ID
+		if n < 2 || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		var h dnsmessage.Header
+		var p dnsmessage.Parser
+		if h, err = p.Start(buf[:n]); err != nil {
+			continue
+		}
+		if h.Truncated {
+			return s.exchangeTCP(ctx, query)
+		}
+		return buf[:n], nil
+	}
+}
+
+// Repeats query over TCP when UDP response is truncated
+func (s *udpServer) exchangeTCP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := s.dial(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return streamExchange(ctx, conn, query)
+}
+
+type tlsServer struct {
+	addr string
+	cfg  *tls.Config
+	dial dialFunc
+}
+
+func (s *tlsServer) String() string {
+	return SCHEME_TLS + "://" + s.addr
+}
+
+func (s *tlsServer) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := s.dial(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, s.cfg)
+	defer tlsConn.Close()
+	return streamExchange(ctx, tlsConn, query)
+}
+
+// Sends query and reads response prefixed with length, as DNS over
+// TCP does
+func streamExchange(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type httpsServer struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpsServer) String() string {
+	return s.url
+}
+
+func (s *httpsServer) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	// RFC 8484 recommends zero ID for cache friendliness
+	msg := make([]byte, len(query))
+	copy(msg, query)
+	msg[0], msg[1] = 0, 0
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad response status: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 2 {
+		return nil, errors.New("short response")
+	}
+	if body[0] != 0 || body[1] != 0 {
+		return nil, errors.New("response ID doesn't match query")
+	}
+	copy(body, query[:2])
+	return body, nil
+}
+
+func buildQuery(name string, qtype dnsmessage.Type) ([]byte, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               binary.BigEndian.Uint16(id[:]),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	return msg.Pack()
+}
+
+// Checks that resp answers query: same ID and question
+func matchResponse(query, resp []byte) error {
+	var qp, rp dnsmessage.Parser
+	qh, err := qp.Start(query)
+	if err != nil {
+		return err
+	}
+	q, err := qp.Question()
+	if err != nil {
+		return err
+	}
+	rh, err := rp.Start(resp)
+	if err != nil {
+		return err
+	}
+	if !rh.Response || rh.ID != qh.ID {
+		return errors.New("response ID doesn't match query")
+	}
+	rq, err := rp.Question()
+	if err == dnsmessage.ErrSectionDone && rh.RCode != dnsmessage.RCodeSuccess {
+		// Error responses may omit question
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rq.Type != q.Type || rq.Class != q.Class || !strings.EqualFold(rq.Name.String(), q.Name.String()) {
+		return fmt.Errorf("response question %s %s doesn't match query", rq.Name, rq.Type)
+	}
+	return nil
+}
+
+// Extracts addresses and smallest TTL of address and CNAME records from
+// response
+func parseResponse(name string, resp []byte) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, 0, fmt.Errorf("server answered %v", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	var (
+		ips    []net.IP
+		ttl    uint32
+		hasTTL bool
+	)
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch ah.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		case dnsmessage.TypeCNAME:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if !hasTTL || ah.TTL < ttl {
+			ttl, hasTTL = ah.TTL, true
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+type lookupResult struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// Queries A and AAAA records of name concurrently
+func lookup(ctx context.Context, srv server, name string) ([]net.IP, time.Duration, error) {
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make(chan lookupResult, len(qtypes))
+	for _, qtype := range qtypes {
+		go func(qtype dnsmessage.Type) {
+			query, err := buildQuery(name, qtype)
+			if err != nil {
+				results <- lookupResult{err: err}
+				return
+			}
+			resp, err := srv.exchange(ctx, query)
+			if err == nil {
+				err = matchResponse(query, resp)
+			}
+			if err != nil {
+				results <- lookupResult{err: err}
+				return
+			}
+			ips, ttl, err := parseResponse(name, resp)
+			results <- lookupResult{ips, ttl, err}
+		}(qtype)
+	}
+	var (
+		ips      []net.IP
+		ttl      time.Duration
+		firstErr error
+	)
+	for range qtypes {
+		res := <-results
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		if len(res.ips) > 0 && (len(ips) == 0 || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+		ips = append(ips, res.ips...)
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
@@ -0,0 +1,407 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testRR struct {
+	name  string
+	ttl   uint32
+	a     string // address of A or AAAA record
+	cname string
+}
+
+// Builds response to A query of qname with given answers
+func buildResponse(t *testing.T, id uint16, rcode dnsmessage.RCode, truncated, compress bool, qname string, answers ...testRR) []byte {
+	return buildAnswer(t, id, rcode, truncated, compress, qname, dnsmessage.TypeA, answers...)
+}
+
+// Builds response to query of qname and qtype with given answers
+func buildAnswer(t *testing.T, id uint16, rcode dnsmessage.RCode, truncated, compress bool, qname string,
+	qtype dnsmessage.Type, answers ...testRR) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 id,
+		Response:           true,
+		RCode:              rcode,
+		Truncated:          truncated,
+		RecursionAvailable: true,
+	})
+	if compress {
+		b.EnableCompression()
+	}
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(b.StartQuestions())
+	must(b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(qname),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}))
+	must(b.StartAnswers())
+	for _, rr := range answers {
+		h := dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(rr.name),
+			Class: dnsmessage.ClassINET,
+			TTL:   rr.ttl,
+		}
+		switch {
+		case rr.cname != "":
+			must(b.CNAMEResource(h, dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(rr.cname)}))
+		case net.ParseIP(rr.a).To4() != nil:
+			var r dnsmessage.AResource
+			copy(r.A[:], net.ParseIP(rr.a).To4())
+			must(b.AResource(h, r))
+		default:
+			var r dnsmessage.AAAAResource
+			copy(r.AAAA[:], net.ParseIP(rr.a))
+			must(b.AAAAResource(h, r))
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestParseResponse(t *testing.T) {
+	const q = "www.example.com."
+	full := buildResponse(t, 1, dnsmessage.RCodeSuccess, false, true, q,
+		testRR{name: q, ttl: 300, a: "192.0.2.1"},
+		testRR{name: q, ttl: 300, a: "192.0.2.2"})
+	cases := []struct {
+		name     string
+		resp     []byte
+		wantIPs  string
+		wantTTL  time.Duration
+		wantErr  bool
+		notFound bool
+	}{
+		{
+			name:    "compressed",
+			resp:    full,
+			wantIPs: "192.0.2.1,192.0.2.2",
+			wantTTL: 300 * time.Second,
+		},
+		{
+			name: "uncompressed",
+			resp: buildResponse(t, 1, dnsmessage.RCodeSuccess, false, false, q,
+				testRR{name: q, ttl: 60, a: "192.0.2.1"}),
+			wantIPs: "192.0.2.1",
+			wantTTL: time.Minute,
+		},
+		{
+			name: "smallest TTL",
+			resp: buildResponse(t, 1, dnsmessage.RCodeSuccess, false, true, q,
+				testRR{name: q, ttl: 300, a: "192.0.2.1"},
+				testRR{name: q, ttl: 30, a: "2001:db8::1"},
+				testRR{name: q, ttl: 600, a: "192.0.2.2"}),
+			wantIPs: "192.0.2.1,2001:db8::1,192.0.2.2",
+			wantTTL: 30 * time.Second,
+		},
+		{
+			name: "zero TTL",
+			resp: buildResponse(t, 1, dnsmessage.RCodeSuccess, false, true, q,
+				testRR{name: q, ttl: 300, a: "192.0.2.1"},
+				testRR{name: q, ttl: 0, a: "192.0.2.2"}),
+			wantIPs: "192.0.2.1,192.0.2.2",
+			wantTTL: 0,
+		},
+		{
+			name: "CNAME chain",
+			resp: buildResponse(t, 1, dnsmessage.RCodeSuccess, false, true, q,
+				testRR{name: q, ttl: 3600, cname: "edge.example.net."},
+				testRR{name: "edge.example.net.", ttl: 20, cname: "node1.cdn.example."},
+				testRR{name: "node1.cdn.example.", ttl: 120, a: "198.51.100.7"}),
+			wantIPs: "198.51.100.7",
+			wantTTL: 20 * time.Second,
+		},
+		{
+			name: "CNAME without addresses",
+			resp: buildResponse(t, 1, dnsmessage.RCodeSuccess, false, true, q,
+				testRR{name: q, ttl: 3600, cname: "edge.example.net."}),
+			wantIPs: "",
+		},
+		{
+			name:    "no answers",
+			resp:    buildResponse(t, 1, dnsmessage.RCodeSuccess, false, true, q),
+			wantIPs: "",
+		},
+		{
+			name:     "NXDOMAIN",
+			resp:     buildResponse(t, 1, dnsmessage.RCodeNameError, false, true, q),
+			wantErr:  true,
+			notFound: true,
+		},
+		{
+			name:    "SERVFAIL",
+			resp:    buildResponse(t, 1, dnsmessage.RCodeServerFailure, false, true, q),
+			wantErr: true,
+		},
+		{
+			name:    "truncated header",
+			resp:    full[:6],
+			wantErr: true,
+		},
+		{
+			name:    "truncated question",
+			resp:    full[:20],
+			wantErr: true,
+		},
+		{
+			name:    "truncated answer",
+			resp:    full[:len(full)-2],
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			resp:    nil,
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ips, ttl, err := parseResponse("www.example.com", c.resp)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want error", ips)
+				}
+				dnsErr, ok := err.(*net.DNSError)
+				if notFound := ok && dnsErr.IsNotFound; notFound != c.notFound {
+					t.Fatalf("got error %v, not found %v, want %v", err, notFound, c.notFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if s := strings.Join(got, ","); s != c.wantIPs {
+				t.Fatalf("got addresses %s, want %s", s, c.wantIPs)
+			}
+			if len(ips) > 0 && ttl != c.wantTTL {
+				t.Fatalf("got TTL %v, want %v", ttl, c.wantTTL)
+			}
+		})
+	}
+}
+
+// Serves single DNS exchange on each dialed connection: datagram for
+// "udp" network and length-prefixed message for "tcp"
+type fakeDNS struct {
+	udp, tcp func(query []byte) []byte
+	dialed   []string
+}
+
+func (f *fakeDNS) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	f.dialed = append(f.dialed, network)
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		buf := make([]byte, maxMessageSize)
+		if network == "udp" {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			server.Write(f.udp(buf[:n]))
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(server, length[:]); err != nil {
+			return
+		}
+		query := buf[:binary.BigEndian.Uint16(length[:])]
+		if _, err := io.ReadFull(server, query); err != nil {
+			return
+		}
+		resp := f.tcp(query)
+		msg := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+		copy(msg[2:], resp)
+		server.Write(msg)
+	}()
+	return client, nil
+}
+
+func TestUDPTruncationFallback(t *testing.T) {
+	const q = "big.example.com."
+	answers := []testRR{
+		{name: q, ttl: 60, a: "192.0.2.1"},
+		{name: q, ttl: 60, a: "192.0.2.2"},
+	}
+	fake := &fakeDNS{
+		udp: func(query []byte) []byte {
+			id := binary.BigEndian.Uint16(query)
+			return buildResponse(t, id, dnsmessage.RCodeSuccess, true, true, q, answers[0])
+		},
+		tcp: func(query []byte) []byte {
+			id := binary.BigEndian.Uint16(query)
+			return buildResponse(t, id, dnsmessage.RCodeSuccess, false, true, q, answers...)
+		},
+	}
+	srv, err := parseServer("192.0.2.53", fake.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := buildQuery("big.example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := srv.exchange(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(fake.dialed, ",") != "udp,tcp" {
+		t.Fatalf("dialed %v, want udp then tcp", fake.dialed)
+	}
+	ips, _, err := parseResponse("big.example.com", resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Fatalf("got %v from TCP response, want both addresses", ips)
+	}
+}
+
+func TestUDPSkipsForeignID(t *testing.T) {
+	const q = "www.example.com."
+	fake := &fakeDNS{
+		udp: func(query []byte) []byte {
+			id := binary.BigEndian.Uint16(query)
+			return buildResponse(t, id+1, dnsmessage.RCodeSuccess, false, true, q,
+				testRR{name: q, ttl: 60, a: "203.0.113.66"})
+		},
+	}
+	srv, _ := parseServer("udp://192.0.2.53:5353", fake.dial)
+	query, _ := buildQuery("www.example.com", dnsmessage.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if resp, err := srv.exchange(ctx, query); err == nil {
+		t.Fatalf("accepted response with other ID: %x", resp)
+	}
+}
+
+func TestParseServer(t *testing.T) {
+	cases := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{spec: "192.0.2.53", want: "udp://192.0.2.53:53"},
+		{spec: "udp://192.0.2.53:5353", want: "udp://192.0.2.53:5353"},
+		{spec: "2001:db8::53", want: "udp://[2001:db8::53]:53"},
+		{spec: "[2001:db8::53]", want: "udp://[2001:db8::53]:53"},
+		{spec: "tls://dns.example", want: "tls://dns.example:853"},
+		{spec: "https://dns.example/dns-query", want: "https://dns.example/dns-query"},
+		{spec: "quic://dns.example", wantErr: true},
+	}
+	for _, c := range cases {
+		srv, err := parseServer(c.spec, nil)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: accepted", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.spec, err)
+			continue
+		}
+		if srv.String() != c.want {
+			t.Errorf("%s: got %s, want %s", c.spec, srv, c.want)
+		}
+	}
+}
+
+func TestMatchResponse(t *testing.T) {
+	const q = "www.example.com."
+	query, err := buildQuery("www.example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := binary.BigEndian.Uint16(query)
+	rr := testRR{name: q, ttl: 60, a: "192.0.2.1"}
+	noQuestion := dnsmessage.Message{Header: dnsmessage.Header{ID: id, Response: true, RCode: dnsmessage.RCodeServerFailure}}
+	refused, err := noQuestion.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		resp    []byte
+		wantErr bool
+	}{
+		{"match", buildAnswer(t, id, dnsmessage.RCodeSuccess, false, true, q, dnsmessage.TypeA, rr), false},
+		{"name case differs", buildAnswer(t, id, dnsmessage.RCodeSuccess, false, true, "WWW.Example.COM.", dnsmessage.TypeA, rr), false},
+		{"error without question", refused, false},
+		{"other ID", buildAnswer(t, id+1, dnsmessage.RCodeSuccess, false, true, q, dnsmessage.TypeA, rr), true},
+		{"other name", buildAnswer(t, id, dnsmessage.RCodeSuccess, false, true, "evil.example.", dnsmessage.TypeA,
+			testRR{name: "evil.example.", ttl: 60, a: "203.0.113.66"}), true},
+		{"other type", buildAnswer(t, id, dnsmessage.RCodeSuccess, false, true, q, dnsmessage.TypeAAAA), true},
+		// Query itself isn't a response
+		{"not a response", query, true},
+		{"garbage", []byte{0, 1, 2}, true},
+	}
+	for _, c := range cases {
+		if err := matchResponse(query, c.resp); (err != nil) != c.wantErr {
+			t.Errorf("%s: got %v, want error %t", c.name, err, c.wantErr)
+		}
+	}
+}
+
+func TestHTTPSMismatchedAnswer(t *testing.T) {
+	const q = "www.example.com."
+	answerFor := "www.example.com."
+	var respID uint16
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query, _ := ioutil.ReadAll(req.Body)
+		if binary.BigEndian.Uint16(query) != 0 {
+			t.Errorf("query ID %x, want zero", query[:2])
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(buildAnswer(t, respID, dnsmessage.RCodeSuccess, false, true, answerFor, dnsmessage.TypeA,
+			testRR{name: answerFor, ttl: 60, a: "192.0.2.1"}))
+	}))
+	defer ts.Close()
+	srv := &httpsServer{ts.URL + "/dns-query", ts.Client()}
+	lookupA := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		query, _ := buildQuery("www.example.com", dnsmessage.TypeA)
+		resp, err := srv.exchange(ctx, query)
+		if err != nil {
+			return err
+		}
+		return matchResponse(query, resp)
+	}
+	if err := lookupA(); err != nil {
+		t.Fatalf("matching answer rejected: %v", err)
+	}
+	respID = 0x1234
+	if err := lookupA(); err == nil {
+		t.Fatal("answer with nonzero ID accepted")
+	}
+	respID, answerFor = 0, "evil.example."
+	if err := lookupA(); err == nil {
+		t.Fatal("answer to other name accepted")
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/Snawoot/udpierce/proto"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+type ACMEOptions struct {
+	// Hostnames to obtain certificates for
+	Hosts []string
+	// Directory where account key and certificates are kept
+	CacheDir string
+	// ACME directory URL. Defaults to Let's Encrypt production
+	// directory.
+	DirectoryURL string
+	// Contact email for CA notifications, optional
+	Email string
+	// File with CA certificates to verify ACME server instead of system
+	// ones, optional. Useful for test servers like Pebble.
+	CAFile string
+}
+
+// Creates ACME certificate manager. Certificates are obtained on first
+// TLS handshake for allowed hostname and renewed in background.
+func NewACMEManager(opts ACMEOptions) (*autocert.Manager, error) {
+	if len(opts.Hosts) == 0 {
+		return nil, errors.New("At least one ACME hostname is required")
+	}
+	if opts.CacheDir == "" {
+		return nil, errors.New("ACME cache directory is required")
+	}
+	client := &acme.Client{
+		DirectoryURL: opts.DirectoryURL,
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if opts.CAFile != "" {
+		roots := x509.NewCertPool()
+		certs, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if ok := roots.AppendCertsFromPEM(certs); !ok {
+			return nil, errors.New("Failed to load ACME CA certificates")
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	whitelist := autocert.HostWhitelist(opts.Hosts...)
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(opts.CacheDir),
+		// HTTP-01 challenge requests carry port in Host header if they
+		// are sent to non-standard port, e.g. by test servers
+		HostPolicy: func(ctx context.Context, host string) error {
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return whitelist(ctx, host)
+		},
+		Client: client,
+		Email:  opts.Email,
+	}, nil
+}
+
+// Builds TLS config with certificates managed by ACME. Config answers
+// TLS-ALPN-01 challenges. Handler returned by HTTPHandler method of
+// manager answers HTTP-01 challenges, see PlainHandler field of Server.
+// CA file and handshake parameters have same meaning as for
+// NewTLSConfig.
+func NewACMETLSConfig(m *autocert.Manager, cafile string, params *proto.TLSParams) (*tls.Config, error) {
+	cfg := tls.Config{
+		GetCertificate: m.GetCertificate,
+	}
+	if err := setClientCAs(&cfg, cafile); err != nil {
+		return nil, err
+	}
+	params.Apply(&cfg)
+	// Server without protocols accepts any offered by client, but with
+	// ACME protocol alone it would reject ones offering ALPN
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"http/1.1"}
+	}
+	cfg.NextProtos = append(append([]string(nil), cfg.NextProtos...), acme.ALPNProto)
+	return &cfg, nil
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrPoolExhausted = errors.New("Address pool exhausted")
+
+type addrLease struct {
+	addr    net.IP
+	active  bool
+	expires time.Time
+}
+
+// addrPool leases host addresses of network to sessions. First host
+// address is reserved for server itself. Released address stays
+// reserved for the same session during lease time, so reconnecting
+// client gets the same address.
+type addrPool struct {
+	network   *net.IPNet
+	gateway   net.IP
+	first     net.IP
+	last      net.IP
+	next      net.IP
+	leaseTime time.Duration
+	leases    map[string]*addrLease
+	owners    map[string]string
+	mux       sync.Mutex
+}
+
+func newAddrPool(network *net.IPNet, leaseTime time.Duration) (*addrPool, error) {
+	base := network.IP.Mask(network.Mask)
+	if base == nil {
+		return nil, fmt.Errorf("Bad address pool %s", network)
+	}
+	bcast := make(net.IP, len(base))
+	for i := range base {
+		bcast[i] = base[i] | ^network.Mask[i]
+	}
+	gateway := ipAdd(base, 1)
+	first := ipAdd(base, 2)
+	last := ipAdd(bcast, -1)
+	if bytes.Compare(first, last) > 0 {
+		return nil, fmt.Errorf("Address pool %s is too small", network)
+	}
+	return &addrPool{
+		network:   &net.IPNet{IP: base, Mask: network.Mask},
+		gateway:   gateway,
+		first:     first,
+		last:      last,
+		next:      first,
+		leaseTime: leaseTime,
+		leases:    make(map[string]*addrLease),
+		owners:    make(map[string]string),
+	}, nil
+}
+
+// Address of server side of the network
+func (p *addrPool) Gateway() *net.IPNet {
+	return &net.IPNet{IP: p.gateway, Mask: p.network.Mask}
+}
+
+// Returns address leased to session, allocating new one if needed
+func (p *addrPool) Acquire(sess_id string) (*net.IPNet, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if l, ok := p.leases[sess_id]; ok {
+		l.active = true
+		return &net.IPNet{IP: l.addr, Mask: p.network.Mask}, nil
+	}
+	now := time.Now()
+	start := p.next
+	for {
+		cand := p.next
+		if bytes.Equal(p.next, p.last) {
+			p.next = p.first
+		} else {
+			p.next = ipAdd(p.next, 1)
+		}
+		key := cand.String()
+		owner, taken := p.owners[key]
+		if taken {
+			l := p.leases[owner]
+			if !l.active && now.After(l.expires) {
+				delete(p.leases, owner)
+				taken = false
+			}
+		}
+		if !taken {
+			p.owners[key] = sess_id
+			p.leases[sess_id] = &addrLease{addr: cand, active: true}
+			return &net.IPNet{IP: cand, Mask: p.network.Mask}, nil
+		}
+		if bytes.Equal(p.next, start) {
+			return nil, ErrPoolExhausted
+		}
+	}
+}
+
+// Returns address leased to session or nil
+func (p *addrPool) Lookup(sess_id string) *net.IPNet {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if l, ok := p.leases[sess_id]; ok {
+		return &net.IPNet{IP: l.addr, Mask: p.network.Mask}
+	}
+	return nil
+}
+
+// Marks address of session as unused. It can be reused by other
+// sessions after lease time.
+func (p *addrPool) Release(sess_id string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if l, ok := p.leases[sess_id]; ok {
+		l.active = false
+		l.expires = time.Now().Add(p.leaseTime)
+	}
+}
+
+// Returns ip + delta. Overflow wraps around.
+func ipAdd(ip net.IP, delta int) net.IP {
+	res := make(net.IP, len(ip))
+	copy(res, ip)
+	carry := delta
+	for i := len(res) - 1; i >= 0 && carry != 0; i-- {
+		sum := int(res[i]) + carry
+		res[i] = byte(sum)
+		carry = sum >> 8
+	}
+	return res
+}
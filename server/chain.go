@@ -0,0 +1,27 @@
+package server
+
+import (
+	"context"
+	"github.com/Snawoot/udpierce/client"
+)
+
+// Creates sink which forwards each session through its own session to
+// another udpierce server
+func NewChainSink(ctx context.Context, sessfact *client.SessionFactory) *SharedSink {
+	return NewSharedSink(func(_ string) (DgramConn, error) {
+		return chainConn{client.NewPacketConn(ctx, sessfact)}, nil
+	})
+}
+
+type chainConn struct {
+	*client.PacketConn
+}
+
+func (c chainConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c chainConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, nil)
+}
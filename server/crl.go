@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Snawoot/udpierce/pki"
+	"github.com/Snawoot/udpierce/proto"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+type CRLOptions struct {
+	// File with one or more PEM or DER encoded CRLs
+	File string
+	// File with CA certificates. Each CRL has to be signed by one of them.
+	CAFile string
+	// Interval between checks of CRL file for changes. Zero disables
+	// reload.
+	Reload time.Duration
+	Logger proto.Logger
+}
+
+// CRL holds certificate revocation lists reloaded from file
+type CRL struct {
+	file    string
+	cas     []*x509.Certificate
+	reload  time.Duration
+	logger  proto.Logger
+	revoked map[string]struct{}
+	mtime   time.Time
+	mux     sync.RWMutex
+}
+
+func NewCRL(opts CRLOptions) (*CRL, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = proto.NopLogger{}
+	}
+	cas, err := loadCerts(opts.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &CRL{
+		file:   opts.File,
+		cas:    cas,
+		reload: opts.Reload,
+		logger: logger,
+	}
+	if _, err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reloads changed CRL file until context is done
+func (c *CRL) Run(ctx context.Context) {
+	if c.reload <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.reload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := c.load()
+		if err != nil {
+			c.logger.Error("CRL reload failed, keeping previous list: %v", err)
+		} else if changed {
+			c.mux.RLock()
+			c.logger.Info("CRL %s reloaded: %d revoked certificates", c.file, len(c.revoked))
+			c.mux.RUnlock()
+		}
+	}
+}
+
+func revocationKey(issuer []byte, serial fmt.Stringer) string {
+	return string(issuer) + "\x00" + serial.String()
+}
+
+func (c *CRL) load() (bool, error) {
+	fi, err := os.Stat(c.file)
+	if err != nil {
+		return false, err
+	}
+	c.mux.RLock()
+	unchanged := fi.ModTime().Equal(c.mtime)
+	c.mux.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return false, err
+	}
+	var ders [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		// Not PEM, try DER
+		ders = append(ders, data)
+	}
+	revoked := make(map[string]struct{})
+	for _, der := range ders {
+		crl, err := pki.ParseCRL(der, nil)
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", c.file, err)
+		}
+		if err := c.checkIssuer(crl); err != nil {
+			return false, fmt.Errorf("%s: %v", c.file, err)
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[revocationKey(crl.RawIssuer, entry.SerialNumber)] = struct{}{}
+		}
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.revoked = revoked
+	c.mtime = fi.ModTime()
+	return true, nil
+}
+
+func (c *CRL) checkIssuer(crl *x509.RevocationList) error {
+	for _, ca := range c.cas {
+		if string(ca.RawSubject) == string(crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return errors.New("CRL is not signed by any of trusted CAs")
+}
+
+// Checks if certificate is revoked
+func (c *CRL) Revoked(cert *x509.Certificate) bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	_, ok := c.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber)]
+	return ok
+}
+
+// Rejects peer chains containing revoked certificates. Suitable for
+// VerifyConnection field of tls.Config, which unlike
+// VerifyPeerCertificate is also called for resumed sessions.
+func (c *CRL) VerifyConnection(cs tls.ConnectionState) error {
+	return c.VerifyChains(cs.VerifiedChains)
+}
+
+// Rejects chains containing revoked certificates
+func (c *CRL) VerifyChains(chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if c.Revoked(cert) {
+				return fmt.Errorf("certificate %q with serial %s is revoked",
+					cert.Subject.CommonName, pki.FormatSerial(cert.SerialNumber))
+			}
+		}
+	}
+	return nil
+}
+
+// Reads PEM certificates from file
+func loadCerts(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("No certificates found in " + filename)
+	}
+	return certs, nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Snawoot/udpierce/proto"
+	"github.com/Snawoot/udpierce/resolver"
+	"net"
+	"os"
+	"time"
+)
+
+// DgramEndpoint maintains datagram socket for each session
+type DgramEndpoint struct {
+	*SharedSink
+	network  string
+	address  string
+	timeout  time.Duration
+	resolver *resolver.Resolver
+	// Addresses of UDP destination resolved once
+	ips  []net.IP
+	port string
+	// Permissions of per-session unixgram sockets. Zero leaves umask default.
+	SocketMode os.FileMode
+	// Setup of UDP sockets, optional
+	SocketOptions *proto.SocketOptions
+}
+
+// Creates endpoint which connects sessions to given address.
+// Network is either "udp" or "unixgram". UDP destination hostnames are
+// looked up with given resolver, nil means system resolver.
+func NewDgramEndpoint(network, address string, timeout time.Duration, resolve_once bool, res *resolver.Resolver) (*DgramEndpoint, error) {
+	e := &DgramEndpoint{
+		network:  network,
+		address:  address,
+		timeout:  timeout,
+		resolver: res,
+	}
+	if resolve_once && network == "udp" {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := e.lookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		e.ips, e.port = ips, port
+	}
+	e.SharedSink = NewSharedSink(e.dialSession)
+	return e, nil
+}
+
+func (e *DgramEndpoint) dialSession(sess_id string) (DgramConn, error) {
+	switch {
+	case e.network == "unixgram":
+		return dialUnixgram(e.address, sess_id, e.SocketMode)
+	case e.ips != nil:
+		return e.dialIPs(e.address, e.ips, e.port)
+	}
+	return e.dialUDP(e.address)
+}
+
+func (e *DgramEndpoint) lookupIP(host string) ([]net.IP, error) {
+	ctx := context.Background()
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+	if e.resolver != nil {
+		return e.resolver.LookupIP(ctx, host)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+func (e *DgramEndpoint) dialUDP(address string) (DgramConn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := e.lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	return e.dialIPs(address, ips, port)
+}
+
+// Connects to first of addresses reachable with socket options
+func (e *DgramEndpoint) dialIPs(address string, ips []net.IP, port string) (DgramConn, error) {
+	dialer := e.SocketOptions.Dialer("udp")
+	dialer.Timeout = e.timeout
+	for _, ip := range ips {
+		if e.SocketOptions.Reachable(ip) {
+			return dialer.Dial("udp", net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return nil, fmt.Errorf("no addresses of %s reachable from source address", address)
+}
+
+// Connects session to destination chosen by client. Supported only for
+// UDP endpoint.
+func (e *DgramEndpoint) ConnectSessionTo(sess_id, dst string) (DgramConn, error) {
+	if e.network != "udp" {
+		return nil, errors.New("Destination choice is supported only for UDP endpoint")
+	}
+	return e.connect(sess_id, dst, func(_ string) (DgramConn, error) {
+		return e.dialUDP(dst)
+	})
+}
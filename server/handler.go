@@ -0,0 +1,324 @@
+package server
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/Snawoot/udpierce/acl"
+	"github.com/Snawoot/udpierce/proto"
+	"github.com/google/uuid"
+	"net"
+	"net/http"
+	"time"
+)
+
+type HandlerOptions struct {
+	// Expected connection request. Defaults to plain CONNECT request.
+	Request *proto.RequestTemplate
+	// Response to accepted connection request. Defaults to bare "200 OK".
+	Hello *proto.ResponseTemplate
+	// Require static password
+	Password string
+	// Require HMAC authentication tokens. Overrides Password.
+	HMACAuth *proto.HMACVerifier
+	// End-to-end frame encryption, optional
+	Crypter *proto.FrameCrypter
+	// Frame padding, optional
+	Padding *proto.Padding
+	// Require verified client TLS certificate
+	RequireTLSAuth bool
+	// Maps client certificates to identities, optional. Implies
+	// RequireTLSAuth, certificates without identity are rejected.
+	Identities *CertIdentities
+	// Restricts client addresses, optional
+	ACL *acl.ACL
+	// Allow clients to choose destination of session. Sink has to
+	// implement DestinationSink.
+	DynamicDst bool
+	// Restricts destinations chosen by clients, optional
+	DstACL *acl.ACL
+	Logger proto.Logger
+}
+
+// Handler is a http.Handler which accepts udpierce connections and
+// bridges them to sink
+type Handler struct {
+	ctx                 context.Context
+	endpoint            Sink
+	acl                 *acl.ACL
+	dynamicDst          bool
+	dstACL              *acl.ACL
+	requireTLSAuth      bool
+	identities          *CertIdentities
+	requirePasswordAuth bool
+	passHash            []byte
+	hmacAuth            *proto.HMACVerifier
+	crypter             *proto.FrameCrypter
+	padding             *proto.Padding
+	reqTemplate         *proto.RequestTemplate
+	hello               *proto.ResponseTemplate
+	logger              proto.Logger
+}
+
+// Creates new handler. All sessions handled are terminated when
+// context is done.
+func NewHandler(ctx context.Context, endpoint Sink, opts HandlerOptions) *Handler {
+	handler := Handler{
+		ctx:            ctx,
+		endpoint:       endpoint,
+		acl:            opts.ACL,
+		dynamicDst:     opts.DynamicDst,
+		dstACL:         opts.DstACL,
+		logger:         opts.Logger,
+		requireTLSAuth: opts.RequireTLSAuth || opts.Identities != nil,
+		identities:     opts.Identities,
+		hmacAuth:       opts.HMACAuth,
+		crypter:        opts.Crypter,
+		padding:        opts.Padding,
+		reqTemplate:    opts.Request,
+		hello:          opts.Hello,
+	}
+	if handler.reqTemplate == nil {
+		handler.reqTemplate = proto.DefaultRequestTemplate()
+	}
+	if handler.hello == nil {
+		handler.hello = proto.DefaultResponseTemplate()
+	}
+	if handler.logger == nil {
+		handler.logger = proto.NopLogger{}
+	}
+	if opts.Password != "" && opts.HMACAuth == nil {
+		passHash := sha256.Sum256([]byte(opts.Password))
+		handler.requirePasswordAuth = true
+		handler.passHash = passHash[:]
+	}
+	return &handler
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if hasPeerIP(req) && !h.acl.AllowedHostPort(req.RemoteAddr) {
+		h.logger.Info("Rejected request from %s: denied by ACL", req.RemoteAddr)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if h.requireTLSAuth {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) < 1 {
+			h.logger.Info("Got unauthorized request (no TLS cert) from %s", req.RemoteAddr)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+	// Peer description used in logs
+	peer := req.RemoteAddr
+	var ident *Identity
+	if h.identities != nil {
+		cert := req.TLS.VerifiedChains[0][0]
+		ident = h.identities.Lookup(cert)
+		if ident == nil {
+			h.logger.Info("Got unauthorized request (certificate %q has no identity) from %s",
+				cert.Subject.CommonName, req.RemoteAddr)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		peer = ident.Name + "@" + req.RemoteAddr
+		if ident.Revoked {
+			h.logger.Info("Got unauthorized request (certificate %q is revoked) from %s",
+				cert.Subject.CommonName, peer)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+	if h.hmacAuth != nil {
+		username, err := h.hmacAuth.Verify(req.Header, h.reqTemplate.Prefix(),
+			req.Header.Get(h.reqTemplate.Prefix()+proto.HDR_SESSION))
+		if err != nil {
+			h.logger.Info("Got unauthorized request (user %q: %v) from %s", username, err, peer)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		h.logger.Debug("User %q authenticated from %s", username, peer)
+	}
+	if h.requirePasswordAuth {
+		sum := sha256.Sum256([]byte(req.Header.Get(h.reqTemplate.Prefix() + proto.HDR_PASSWD)))
+		ok := subtle.ConstantTimeCompare(
+			sum[:],
+			h.passHash)
+		if ok != 1 {
+			h.logger.Info("Got unauthorized request (password mismatch) from %s", peer)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+	if !h.reqTemplate.Matches(req) {
+		h.logger.Info("Bad request method or path (%s %s) from %s", req.Method, req.URL.Path, peer)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	uuid_bytes, err := uuid.Parse(req.Header.Get(h.reqTemplate.Prefix() + proto.HDR_SESSION))
+	if err != nil {
+		h.logger.Error("Bad request from %s: no parseable session UUID", peer)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	sess_id := hex.EncodeToString(uuid_bytes[:])
+	if ident != nil {
+		if !h.identities.Acquire(ident, sess_id) {
+			h.logger.Info("Rejected session %s from %s: identity session limit exceeded", sess_id, peer)
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		defer h.identities.Release(ident, sess_id)
+	}
+	h.logger.Info("Incoming session %s from %s", sess_id, peer)
+	if req.TLS != nil {
+		h.logger.Debug("TLS session of %s resumed: %t", peer, req.TLS.DidResume)
+	}
+
+	dst := req.Header.Get(h.reqTemplate.Prefix() + proto.HDR_DEST)
+	var dstSink DestinationSink
+	if dst != "" {
+		var ok bool
+		dstSink, ok = h.endpoint.(DestinationSink)
+		if !h.dynamicDst || !ok {
+			h.logger.Info("Rejected session %s from %s: destination choice is not allowed", sess_id, peer)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !h.dstACL.AllowedHostPort(dst) {
+			h.logger.Info("Rejected session %s from %s: destination %s denied by ACL", sess_id, peer, dst)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if ident != nil && !ident.AllowedDestination(dst) {
+			h.logger.Info("Rejected session %s from %s: destination %s is not allowed for identity", sess_id, peer, dst)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.logger.Info("Session %s requested destination %s", sess_id, dst)
+	}
+
+	var dgram_conn DgramConn
+	if dstSink != nil {
+		dgram_conn, err = dstSink.ConnectSessionTo(sess_id, dst)
+	} else {
+		dgram_conn, err = h.endpoint.ConnectSession(sess_id)
+	}
+	if err == ErrDestinationMismatch {
+		h.logger.Info("Rejected session %s from %s: session is connected to other destination", sess_id, peer)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		h.logger.Error("Endpoint connection failed: %v", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer h.endpoint.DisconnectSession(sess_id)
+	var helloHeader http.Header
+	if as, ok := h.endpoint.(AddressedSink); ok {
+		if addr := as.SessionAddress(sess_id); addr != "" {
+			helloHeader = http.Header{h.reqTemplate.Prefix() + proto.HDR_ADDRESS: []string{addr}}
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		h.logger.Critical("Webserver doesn't support hijacking")
+		http.Error(w, "Webserver doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+	stream_conn, _, err := hj.Hijack()
+	if err != nil {
+		h.logger.Error("Can't hijack client connection: %v", err)
+		http.Error(w, "Can't hijack client connection", http.StatusInternalServerError)
+		return
+	}
+	defer stream_conn.Close()
+	var emptytime time.Time
+	err = stream_conn.SetDeadline(emptytime)
+	if err != nil {
+		h.logger.Error("Can't clear deadlines on local connection: %v", err)
+		return
+	}
+	_, err = stream_conn.Write(h.hello.HelloWith(helloHeader))
+	if err != nil {
+		h.logger.Error("Can't write hello message to %s: %v", peer, err)
+		return
+	}
+	var sendAEAD, recvAEAD cipher.AEAD
+	if h.crypter != nil {
+		sendAEAD, recvAEAD, err = h.crypter.ServerHandshake(stream_conn)
+		if err != nil {
+			h.logger.Error("Encryption handshake with %s failed: %v", peer, err)
+			return
+		}
+	}
+
+	h.bridgeEndpoint(stream_conn, dgram_conn, sendAEAD, recvAEAD)
+	h.logger.Info("Session %s from %s terminated", sess_id, peer)
+}
+
+func (h *Handler) bridgeEndpoint(stream_conn net.Conn, dgram_conn DgramConn, sendAEAD, recvAEAD cipher.AEAD) {
+	done := make(chan struct{}, 2)
+	go func() {
+		defer func() {
+			done <- struct{}{}
+		}()
+		fr := proto.NewFrameReader(stream_conn, recvAEAD, h.padding)
+		for {
+			data, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			n, err := dgram_conn.Write(data)
+			if err != nil || n != len(data) {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer func() {
+			done <- struct{}{}
+		}()
+		buf := make([]byte, proto.DGRAM_BUF)
+		fw := proto.NewFrameWriter(stream_conn, sendAEAD, h.padding)
+		fw.StartCover()
+		defer fw.StopCover()
+		for {
+			dgram_len, err := dgram_conn.Read(buf)
+			if err != nil {
+				return
+			}
+			err = fw.WriteFrame(buf[:dgram_len])
+			if err == proto.ErrFrameTooLarge {
+				continue
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-h.ctx.Done():
+	}
+}
+
+// Reports whether request came through unix socket listener
+func isUnixRequest(req *http.Request) bool {
+	laddr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && laddr.Network() == "unix"
+}
+
+// Reports whether request carries peer IP address to check against
+// ACL. Requests through unix socket listener have it only if it was
+// restored from proxy headers.
+func hasPeerIP(req *http.Request) bool {
+	if !isUnixRequest(req) {
+		return true
+	}
+	_, _, err := net.SplitHostPort(req.RemoteAddr)
+	return err == nil
+}
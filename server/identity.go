@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"github.com/Snawoot/udpierce/pki"
+	"github.com/Snawoot/udpierce/proto"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity is an owner of client certificates with own access rules
+type Identity struct {
+	// Name used in logs
+	Name string
+	// Networks of destinations identity may choose. Empty list allows
+	// any destination permitted by server.
+	Destinations []*net.IPNet
+	// Limit of concurrent sessions, zero means unlimited
+	MaxSessions int
+	// Certificates mapped to identity are rejected
+	Revoked bool
+}
+
+// Checks destination in host:port form against identity networks
+func (i *Identity) AllowedDestination(hostport string) bool {
+	if len(i.Destinations) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range i.Destinations {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Certificate matchers
+const (
+	MATCH_ANY    = "*"
+	MATCH_CN     = "cn"
+	MATCH_SAN    = "san"
+	MATCH_SHA256 = "sha256"
+	MATCH_SERIAL = "serial"
+)
+
+type identityRule struct {
+	kind     string
+	value    string
+	serial   *big.Int
+	identity *Identity
+}
+
+func (r *identityRule) matches(cert *x509.Certificate) bool {
+	switch r.kind {
+	case MATCH_ANY:
+		return true
+	case MATCH_CN:
+		return cert.Subject.CommonName == r.value
+	case MATCH_SAN:
+		for _, name := range cert.DNSNames {
+			if name == r.value {
+				return true
+			}
+		}
+		for _, email := range cert.EmailAddresses {
+			if email == r.value {
+				return true
+			}
+		}
+		for _, uri := range cert.URIs {
+			if uri.String() == r.value {
+				return true
+			}
+		}
+		for _, ip := range cert.IPAddresses {
+			if ip.String() == r.value {
+				return true
+			}
+		}
+	case MATCH_SHA256:
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:]) == r.value
+	case MATCH_SERIAL:
+		return cert.SerialNumber.Cmp(r.serial) == 0
+	}
+	return false
+}
+
+// Parses rule line in form MATCHER IDENTITY [OPTION...]
+func parseIdentityRule(line string) (*identityRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected \"MATCHER IDENTITY [OPTION...]\"")
+	}
+	var rule identityRule
+	if fields[0] == MATCH_ANY {
+		rule.kind = MATCH_ANY
+	} else {
+		idx := strings.IndexByte(fields[0], ':')
+		if idx < 0 {
+			return nil, fmt.Errorf("bad matcher %q: expected KIND:VALUE or %s", fields[0], MATCH_ANY)
+		}
+		rule.kind, rule.value = fields[0][:idx], fields[0][idx+1:]
+	}
+	switch rule.kind {
+	case MATCH_ANY, MATCH_CN, MATCH_SAN:
+	case MATCH_SHA256:
+		rule.value = strings.ToLower(strings.Replace(rule.value, ":", "", -1))
+		if b, err := hex.DecodeString(rule.value); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("bad certificate fingerprint %q", rule.value)
+		}
+	case MATCH_SERIAL:
+		serial, err := pki.ParseSerial(rule.value)
+		if err != nil {
+			return nil, err
+		}
+		rule.serial = serial
+	default:
+		return nil, fmt.Errorf("unknown matcher kind %q", rule.kind)
+	}
+	ident := &Identity{Name: fields[1]}
+	for _, opt := range fields[2:] {
+		kv := strings.SplitN(opt, "=", 2)
+		switch {
+		case kv[0] == "revoked" && len(kv) == 1:
+			ident.Revoked = true
+		case kv[0] == "dst" && len(kv) == 2:
+			for _, cidr := range strings.Split(kv[1], ",") {
+				_, n, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return nil, err
+				}
+				ident.Destinations = append(ident.Destinations, n)
+			}
+		case kv[0] == "max-sessions" && len(kv) == 2:
+			limit, err := strconv.Atoi(kv[1])
+			if err != nil || limit < 0 {
+				return nil, fmt.Errorf("bad session limit %q", kv[1])
+			}
+			ident.MaxSessions = limit
+		default:
+			return nil, fmt.Errorf("unknown option %q", opt)
+		}
+	}
+	rule.identity = ident
+	return &rule, nil
+}
+
+// Reads identity rules from file. Empty lines and lines starting
+// with '#' are ignored.
+func loadIdentityRules(filename string) ([]*identityRule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []*identityRule
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		rule, err := parseIdentityRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// CertIdentities maps client certificates to identities according to
+// rules from file and tracks sessions of each identity. First matching
+// rule wins. Each rule line has form
+//
+//	MATCHER IDENTITY [OPTION...]
+//
+// where MATCHER is one of "cn:NAME", "san:NAME", "sha256:FINGERPRINT",
+// "serial:SERIAL" or "*", and options are "dst=CIDR[,CIDR...]",
+// "max-sessions=N" and "revoked".
+type CertIdentities struct {
+	file     string
+	mtime    time.Time
+	rules    []*identityRule
+	sessions map[string]map[string]int
+	mux      sync.RWMutex
+	logger   proto.Logger
+}
+
+func NewCertIdentities(filename string, logger proto.Logger) (*CertIdentities, error) {
+	if logger == nil {
+		logger = proto.NopLogger{}
+	}
+	ci := &CertIdentities{
+		file:     filename,
+		sessions: make(map[string]map[string]int),
+		logger:   logger,
+	}
+	if _, err := ci.load(); err != nil {
+		return nil, err
+	}
+	return ci, nil
+}
+
+// Periodically reloads changed rules file until context is done
+func (ci *CertIdentities) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := ci.load()
+		if err != nil {
+			ci.logger.Error("Identities reload from %s failed: %v", ci.file, err)
+		} else if changed {
+			ci.logger.Info("Identities reloaded from %s", ci.file)
+		}
+	}
+}
+
+func (ci *CertIdentities) load() (bool, error) {
+	fi, err := os.Stat(ci.file)
+	if err != nil {
+		return false, err
+	}
+	ci.mux.RLock()
+	unchanged := fi.ModTime().Equal(ci.mtime)
+	ci.mux.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	rules, err := loadIdentityRules(ci.file)
+	if err != nil {
+		return false, err
+	}
+	ci.mux.Lock()
+	defer ci.mux.Unlock()
+	ci.rules = rules
+	ci.mtime = fi.ModTime()
+	return true, nil
+}
+
+// Returns identity of certificate or nil if no rule matches
+func (ci *CertIdentities) Lookup(cert *x509.Certificate) *Identity {
+	ci.mux.RLock()
+	defer ci.mux.RUnlock()
+	for _, rule := range ci.rules {
+		if rule.matches(cert) {
+			return rule.identity
+		}
+	}
+	return nil
+}
+
+// Registers connection of session. Returns false if identity session
+// limit is exceeded. Each successful call has to be paired with Release.
+func (ci *CertIdentities) Acquire(ident *Identity, sess_id string) bool {
+	ci.mux.Lock()
+	defer ci.mux.Unlock()
+	sessions := ci.sessions[ident.Name]
+	if sessions == nil {
+		sessions = make(map[string]int)
+		ci.sessions[ident.Name] = sessions
+	}
+	if _, ok := sessions[sess_id]; !ok && ident.MaxSessions > 0 && len(sessions) >= ident.MaxSessions {
+		return false
+	}
+	sessions[sess_id]++
+	return true
+}
+
+// Unregisters connection of session
+func (ci *CertIdentities) Release(ident *Identity, sess_id string) {
+	ci.mux.Lock()
+	defer ci.mux.Unlock()
+	sessions := ci.sessions[ident.Name]
+	if sessions[sess_id]--; sessions[sess_id] <= 0 {
+		delete(sessions, sess_id)
+	}
+	if len(sessions) == 0 {
+		delete(ci.sessions, ident.Name)
+	}
+}
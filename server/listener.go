@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// Prepares accepted connection for serving. Returns nil if connection
+// was consumed or dropped.
+type connPreparer func(conn net.Conn) net.Conn
+
+// Chains preparers, each one is applied to result of previous
+func chainPreparers(preparers ...connPreparer) connPreparer {
+	return func(conn net.Conn) net.Conn {
+		for _, prepare := range preparers {
+			if conn = prepare(conn); conn == nil {
+				return nil
+			}
+		}
+		return conn
+	}
+}
+
+// asyncListener prepares accepted connections in own goroutines, so
+// slow clients don't hold Accept
+type asyncListener struct {
+	net.Listener
+	prepare connPreparer
+	// Prepared connection -> address of its TCP peer
+	peers     sync.Map
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newAsyncListener(ln net.Listener, prepare connPreparer) *asyncListener {
+	l := &asyncListener{
+		Listener: ln,
+		prepare:  prepare,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *asyncListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+				continue
+			case <-l.closed:
+				return
+			}
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *asyncListener) handle(conn net.Conn) {
+	peer := conn.RemoteAddr()
+	if conn = l.prepare(conn); conn == nil {
+		return
+	}
+	l.peers.Store(conn, peer)
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		l.peers.Delete(conn)
+		conn.Close()
+	}
+}
+
+// Returns address of TCP peer of accepted connection, which differs
+// from its RemoteAddr if latter was restored from PROXY protocol header.
+// Address is forgotten once returned.
+func (l *asyncListener) peerAddr(conn net.Conn) net.Addr {
+	peer, ok := l.peers.Load(conn)
+	if !ok {
+		return conn.RemoteAddr()
+	}
+	l.peers.Delete(conn)
+	return peer.(net.Addr)
+}
+
+func (l *asyncListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *asyncListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/Snawoot/udpierce/proto"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MuxOptions struct {
+	// Server names handled by udpierce. Empty list matches any name.
+	ServerNames []string
+	// ALPN protocols handled by udpierce: connections offering any of
+	// them are matched. Empty list matches any connection.
+	ALPN []string
+	// Address of TCP backend for other connections
+	Backend string
+	// Backend connect timeout. Defaults to SNIFF_TIMEOUT.
+	Timeout time.Duration
+	Logger  proto.Logger
+}
+
+// Mux selects TLS connections handled by udpierce by server name and
+// ALPN protocols of ClientHello. Other connections are passed as is to
+// backend, so udpierce can share port with other TLS service.
+type Mux struct {
+	serverNames map[string]struct{}
+	alpn        map[string]struct{}
+	backend     string
+	timeout     time.Duration
+	logger      proto.Logger
+}
+
+func NewMux(opts MuxOptions) *Mux {
+	m := &Mux{
+		backend: opts.Backend,
+		timeout: opts.Timeout,
+		logger:  opts.Logger,
+	}
+	if m.timeout <= 0 {
+		m.timeout = SNIFF_TIMEOUT
+	}
+	if m.logger == nil {
+		m.logger = proto.NopLogger{}
+	}
+	if len(opts.ServerNames) > 0 {
+		m.serverNames = make(map[string]struct{})
+		for _, name := range opts.ServerNames {
+			m.serverNames[strings.ToLower(name)] = struct{}{}
+		}
+	}
+	if len(opts.ALPN) > 0 {
+		m.alpn = make(map[string]struct{})
+		for _, p := range opts.ALPN {
+			m.alpn[p] = struct{}{}
+		}
+	}
+	return m
+}
+
+// Reports whether connection with given ClientHello is handled by
+// udpierce
+func (m *Mux) Matches(hello *tls.ClientHelloInfo) bool {
+	if m.serverNames != nil {
+		if _, ok := m.serverNames[strings.ToLower(hello.ServerName)]; !ok {
+			return false
+		}
+	}
+	if m.alpn != nil {
+		for _, p := range hello.SupportedProtos {
+			if _, ok := m.alpn[p]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Connects client connection to backend and copies data both ways
+// until both sides are done. End of input of one side is passed to
+// other as half-close.
+func (m *Mux) pass(conn net.Conn) {
+	defer conn.Close()
+	backend, err := net.DialTimeout("tcp", m.backend, m.timeout)
+	if err != nil {
+		m.logger.Error("Can't connect to backend %s for %s: %v", m.backend, conn.RemoteAddr(), err)
+		return
+	}
+	defer backend.Close()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			// Broken connection won't be half-closed by peer
+			conn.Close()
+			backend.Close()
+			return
+		}
+		closeWrite(dst)
+	}
+	go copyHalf(backend, conn)
+	go copyHalf(conn, backend)
+	wg.Wait()
+}
+
+// Shuts down writing side of connection, unwrapping connections of
+// sniffer and PROXY protocol. Connections without half-close support
+// are closed.
+func closeWrite(conn net.Conn) error {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	case *peekedConn:
+		return closeWrite(c.Conn)
+	case *proxiedConn:
+		return closeWrite(c.Conn)
+	}
+	return conn.Close()
+}
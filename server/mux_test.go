@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// Backend answers only after client is done sending
+func TestMuxPassHalfClose(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := ioutil.ReadAll(conn)
+		conn.Write(append([]byte("got "), req...))
+	}()
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	m := NewMux(MuxOptions{Backend: backend.Addr().String()})
+	passed := make(chan struct{})
+	go func() {
+		defer close(passed)
+		conn, err := front.Accept()
+		if err != nil {
+			return
+		}
+		// Wrapped like connections coming from sniffer
+		m.pass(&peekedConn{conn, bufio.NewReader(conn)})
+	}()
+
+	client, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "got request" {
+		t.Fatalf("got %q, want backend answer after half-close", resp)
+	}
+	select {
+	case <-passed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pass didn't finish after both sides were done")
+	}
+}
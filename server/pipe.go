@@ -0,0 +1,77 @@
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+const PIPE_QLEN = 128
+
+// SessionHandler serves datagrams of single session in-process. Conn is
+// closed when session is gone; handler should return then.
+type SessionHandler func(sess_id string, conn DgramConn)
+
+// Creates sink which passes sessions to in-process handler. Handler
+// is called in own goroutine for each new session.
+func NewHandlerSink(handler SessionHandler) *SharedSink {
+	return NewSharedSink(func(sess_id string) (DgramConn, error) {
+		local, remote := DgramPipe()
+		go func() {
+			handler(sess_id, remote)
+			remote.Close()
+		}()
+		return local, nil
+	})
+}
+
+type pipeShared struct {
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type pipeEnd struct {
+	shared *pipeShared
+	rx     <-chan []byte
+	tx     chan<- []byte
+}
+
+// Returns pair of connected in-memory datagram connections. Datagrams
+// are dropped if reading side can't keep up. Closing either end
+// closes both.
+func DgramPipe() (DgramConn, DgramConn) {
+	shared := &pipeShared{done: make(chan struct{})}
+	a2b := make(chan []byte, PIPE_QLEN)
+	b2a := make(chan []byte, PIPE_QLEN)
+	return &pipeEnd{shared, b2a, a2b}, &pipeEnd{shared, a2b, b2a}
+}
+
+func (p *pipeEnd) Read(b []byte) (int, error) {
+	select {
+	case dgram := <-p.rx:
+		return copy(b, dgram), nil
+	case <-p.shared.done:
+		return 0, io.EOF
+	}
+}
+
+func (p *pipeEnd) Write(b []byte) (int, error) {
+	select {
+	case <-p.shared.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	dgram := make([]byte, len(b))
+	copy(dgram, b)
+	select {
+	case p.tx <- dgram:
+	default:
+	}
+	return len(b), nil
+}
+
+func (p *pipeEnd) Close() error {
+	p.shared.closeOnce.Do(func() {
+		close(p.shared.done)
+	})
+	return nil
+}
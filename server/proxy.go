@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Snawoot/udpierce/proto"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TrustedProxyOptions struct {
+	// Networks of trusted proxies
+	Networks []*net.IPNet
+	// Trust peers of unix socket listener. Any local process able to
+	// connect to socket can pass client address and certificate then.
+	TrustUnix bool
+	// Take client address from X-Forwarded-For header
+	ForwardedFor bool
+	// Header with URL-encoded PEM client certificate verified by proxy,
+	// e.g. nginx $ssl_client_escaped_cert. Optional.
+	CertHeader string
+	// File with CA certificates to verify certificate from header
+	// against. Required with CertHeader.
+	CAFile string
+	// Checks verified client certificate chains from header, optional
+	VerifyChains func(chains [][]*x509.Certificate) error
+	Logger       proto.Logger
+}
+
+// TrustedProxy restores client address and certificate passed by
+// reverse proxy in PROXY protocol header or HTTP request headers.
+// Information is taken only from trusted proxies.
+type TrustedProxy struct {
+	networks     []*net.IPNet
+	trustUnix    bool
+	forwardedFor bool
+	certHeader   string
+	clientCAs    *x509.CertPool
+	verifyChains func(chains [][]*x509.Certificate) error
+	logger       proto.Logger
+}
+
+func NewTrustedProxy(opts TrustedProxyOptions) (*TrustedProxy, error) {
+	var clientCAs *x509.CertPool
+	if opts.CertHeader != "" {
+		if opts.CAFile == "" {
+			return nil, errors.New("Client certificate header requires CA file")
+		}
+		var err error
+		clientCAs, err = loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p := &TrustedProxy{
+		networks:     opts.Networks,
+		trustUnix:    opts.TrustUnix,
+		forwardedFor: opts.ForwardedFor,
+		certHeader:   http.CanonicalHeaderKey(opts.CertHeader),
+		clientCAs:    clientCAs,
+		verifyChains: opts.VerifyChains,
+		logger:       opts.Logger,
+	}
+	if p.logger == nil {
+		p.logger = proto.NopLogger{}
+	}
+	return p, nil
+}
+
+// Reports whether peer is trusted proxy
+func (p *TrustedProxy) Trusted(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UnixAddr:
+		return p.trustUnix
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	for _, n := range p.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{ name string }
+
+// Context key of address of TCP peer of connection, which carries
+// request. Unlike request remote address it isn't replaced with one
+// from PROXY protocol header.
+var peerAddrContextKey = &contextKey{"peer-addr"}
+
+func (p *TrustedProxy) trustedRequest(req *http.Request) bool {
+	if isUnixRequest(req) {
+		return p.trustUnix
+	}
+	peer, ok := req.Context().Value(peerAddrContextKey).(net.Addr)
+	return ok && p.Trusted(peer)
+}
+
+// Wraps handler, so requests from trusted proxies get client address
+// from X-Forwarded-For header and client certificate from certificate
+// header, if enabled. Certificate from header is presented to handler
+// as verified TLS client certificate. Proxy is recognized by TCP peer
+// address of connection, so handler has to be served by Server.
+func (p *TrustedProxy) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !p.trustedRequest(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		r := new(http.Request)
+		*r = *req
+		if p.forwardedFor {
+			if ip := lastForwardedFor(req.Header); ip != nil {
+				r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+			}
+		}
+		if p.certHeader != "" {
+			if value := req.Header.Get(p.certHeader); value != "" {
+				chains, err := p.verifyCert(value)
+				if err != nil {
+					p.logger.Info("Rejected client certificate from header for %s: %v", r.RemoteAddr, err)
+				} else {
+					var state tls.ConnectionState
+					if req.TLS != nil {
+						state = *req.TLS
+					}
+					state.PeerCertificates = chains[0]
+					state.VerifiedChains = chains
+					r.TLS = &state
+				}
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Returns rightmost valid address from X-Forwarded-For headers, which
+// is the one added by trusted proxy
+func lastForwardedFor(header http.Header) net.IP {
+	values := header.Values("X-Forwarded-For")
+	for i := len(values) - 1; i >= 0; i-- {
+		parts := strings.Split(values[i], ",")
+		for j := len(parts) - 1; j >= 0; j-- {
+			if ip := net.ParseIP(strings.TrimSpace(parts[j])); ip != nil {
+				return ip
+			}
+		}
+	}
+	return nil
+}
+
+func (p *TrustedProxy) verifyCert(value string) ([][]*x509.Certificate, error) {
+	unescaped, err := url.QueryUnescape(value)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	rest := []byte(unescaped)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         p.clientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(opts)
+	if err != nil {
+		return nil, err
+	}
+	if p.verifyChains != nil {
+		if err := p.verifyChains(chains); err != nil {
+			return nil, err
+		}
+	}
+	return chains, nil
+}
+
+// PROXY protocol signatures
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Longest PROXY protocol v1 header
+const proxyV1MaxLen = 107
+
+// proxiedConn is a connection which reports client address from PROXY
+// protocol header
+type proxiedConn struct {
+	net.Conn
+	r      io.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Reads PROXY protocol header from connections of trusted proxies.
+// Connections of others are served as is.
+func (p *TrustedProxy) prepare(conn net.Conn) net.Conn {
+	if !p.Trusted(conn.RemoteAddr()) {
+		return conn
+	}
+	conn.SetReadDeadline(time.Now().Add(SNIFF_TIMEOUT))
+	r := bufio.NewReader(conn)
+	remote, err := readProxyHeader(r)
+	if err != nil {
+		p.logger.Error("Bad PROXY protocol header from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil
+	}
+	var emptytime time.Time
+	conn.SetReadDeadline(emptytime)
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxiedConn{conn, r, remote}
+}
+
+// Reads PROXY protocol v1 or v2 header. Returns nil address for
+// connections originated by proxy itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	return nil, errors.New("no PROXY protocol signature")
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("header is too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("bad v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("bad v1 source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	verCmd, family := hdr[12], hdr[13]
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL: health check or other connection of proxy itself
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("unsupported command %d", verCmd&0xf)
+	}
+	switch family >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, errors.New("short IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:])),
+		}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, errors.New("short IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:])),
+		}, nil
+	case 0, 3:
+		// AF_UNSPEC and unix addresses carry no client IP
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported address family %d", family>>4)
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestTrusted(t *testing.T) {
+	cases := []struct {
+		addr      net.Addr
+		trustUnix bool
+		want      bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, false, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}, true, false},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, false, false},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, true, true},
+		{&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, true, false},
+	}
+	for _, c := range cases {
+		tp, err := NewTrustedProxy(TrustedProxyOptions{
+			Networks:  []*net.IPNet{mustCIDR(t, "10.0.0.0/8")},
+			TrustUnix: c.trustUnix,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tp.Trusted(c.addr); got != c.want {
+			t.Errorf("%s %s, trust unix %t: got %t, want %t", c.addr.Network(), c.addr, c.trustUnix, got, c.want)
+		}
+	}
+}
+
+func TestTrustedProxyUsesTCPPeer(t *testing.T) {
+	cases := []struct {
+		name          string
+		trusted       string
+		proxyProtocol bool
+		prologue      string
+		want          string
+	}{
+		{
+			name:    "trusted peer",
+			trusted: "127.0.0.1/32",
+			want:    "192.0.2.7",
+		},
+		{
+			name:    "untrusted peer",
+			trusted: "192.0.2.0/24",
+			want:    "127.0.0.1",
+		},
+		{
+			name:          "trusted proxy reports untrusted client",
+			trusted:       "127.0.0.1/32",
+			proxyProtocol: true,
+			prologue:      "PROXY TCP4 198.51.100.1 127.0.0.1 1234 8911\r\n",
+			want:          "192.0.2.7",
+		},
+		{
+			name:          "untrusted peer with proxy protocol",
+			trusted:       "198.51.100.0/24",
+			proxyProtocol: true,
+			want:          "127.0.0.1",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tp, err := NewTrustedProxy(TrustedProxyOptions{
+				Networks:     []*net.IPNet{mustCIDR(t, c.trusted)},
+				ForwardedFor: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := &Server{
+				Handler: tp.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					host, _, _ := net.SplitHostPort(req.RemoteAddr)
+					fmt.Fprint(w, host)
+				})),
+			}
+			if c.proxyProtocol {
+				srv.ProxyProtocol = tp
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go srv.Serve(ctx, ln)
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: x\r\nX-Forwarded-For: 192.0.2.7\r\n\r\n", c.prologue)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var got string
+			fmt.Fscan(resp.Body, &got)
+			if got != c.want {
+				t.Fatalf("handler saw client %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func proxyV2(verCmd, family byte, payload []byte) string {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, verCmd, family, byte(len(payload)>>8), byte(len(payload)))
+	return string(append(hdr, payload...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{
+		192, 0, 2, 1, // source
+		127, 0, 0, 1, // destination
+		0x30, 0x39, // source port 12345
+		0x22, 0xcf, // destination port 8911
+	}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("::1"))
+	v6[32], v6[33] = 0x30, 0x39
+	tlv := []byte{0x04, 0x00, 0x03, 'a', 'b', 'c'} // PP2_TYPE_NOOP
+	cases := []struct {
+		name    string
+		input   string
+		want    string // "" for connection of proxy itself
+		wantErr bool
+	}{
+		{name: "v1 tcp4", input: "PROXY TCP4 192.0.2.1 127.0.0.1 12345 8911\r\n", want: "192.0.2.1:12345"},
+		{name: "v1 tcp6", input: "PROXY TCP6 2001:db8::1 ::1 12345 8911\r\n", want: "[2001:db8::1]:12345"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\n"},
+		{name: "v1 unknown with addresses", input: "PROXY UNKNOWN ::1 ::1 1 2\r\n"},
+		{name: "v1 bad protocol", input: "PROXY UDP4 192.0.2.1 127.0.0.1 1 2\r\n", wantErr: true},
+		{name: "v1 missing fields", input: "PROXY TCP4 192.0.2.1 127.0.0.1 1\r\n", wantErr: true},
+		{name: "v1 bad address", input: "PROXY TCP4 192.0.2.300 127.0.0.1 1 2\r\n", wantErr: true},
+		{name: "v1 family mismatch", input: "PROXY TCP4 2001:db8::1 ::1 1 2\r\n", wantErr: true},
+		{name: "v1 port out of range", input: "PROXY TCP4 192.0.2.1 127.0.0.1 65536 2\r\n", wantErr: true},
+		{name: "v1 negative port", input: "PROXY TCP4 192.0.2.1 127.0.0.1 -1 2\r\n", wantErr: true},
+		{name: "v1 truncated", input: "PROXY TCP4 192.0.2.1 127.0.0.1 1 2", wantErr: true},
+		{name: "v1 too long", input: "PROXY " + string(bytes.Repeat([]byte{'x'}, 200)) + "\r\n", wantErr: true},
+		{name: "v2 tcp4", input: proxyV2(0x21, 0x11, v4), want: "192.0.2.1:12345"},
+		{name: "v2 tcp6", input: proxyV2(0x21, 0x21, v6), want: "[2001:db8::1]:12345"},
+		{name: "v2 tcp4 with TLV", input: proxyV2(0x21, 0x11, append(append([]byte(nil), v4...), tlv...)), want: "192.0.2.1:12345"},
+		{name: "v2 local", input: proxyV2(0x20, 0x00, nil)},
+		{name: "v2 local with addresses", input: proxyV2(0x20, 0x11, v4)},
+		{name: "v2 unspec", input: proxyV2(0x21, 0x00, nil)},
+		{name: "v2 unix", input: proxyV2(0x21, 0x31, make([]byte, 216))},
+		{name: "v2 short ipv4 block", input: proxyV2(0x21, 0x11, v4[:11]), wantErr: true},
+		{name: "v2 short ipv6 block", input: proxyV2(0x21, 0x21, v4), wantErr: true},
+		{name: "v2 unknown family", input: proxyV2(0x21, 0x41, v4), wantErr: true},
+		{name: "v2 bad version", input: proxyV2(0x11, 0x11, v4), wantErr: true},
+		{name: "v2 bad command", input: proxyV2(0x22, 0x11, v4), wantErr: true},
+		{name: "v2 truncated header", input: proxyV2(0x21, 0x11, v4)[:14], wantErr: true},
+		{name: "v2 truncated payload", input: proxyV2(0x21, 0x11, v4)[:20], wantErr: true},
+		{name: "no signature", input: "GET / HTTP/1.1\r\n\r\n", wantErr: true},
+		{name: "empty", input: "", wantErr: true},
+	}
+	const rest = "GET / HTTP/1.1\r\n"
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(c.input + rest))
+			if c.wantErr {
+				// Truncated input must not be completed by following data
+				r = bufio.NewReader(strings.NewReader(c.input))
+			}
+			addr, err := readProxyHeader(r)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("got address %v, want error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != c.want {
+				t.Fatalf("got address %q, want %q", got, c.want)
+			}
+			tail, _ := ioutil.ReadAll(r)
+			if string(tail) != rest {
+				t.Fatalf("header consumed wrong amount of data, left %q", tail)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Package server implements udpierce server side: HTTP handler which
+// accepts client connections and forwards datagrams to endpoint.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/Snawoot/udpierce/proto"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
+type Server struct {
+	// Listen address: TCP host:port or unix socket path
+	Addr string
+	// Either "tcp" (default) or "unix"
+	Network string
+	// Permissions of unix socket file. Zero leaves umask default.
+	SocketMode os.FileMode
+	// Enables TLS if set
+	TLSConfig *tls.Config
+	Handler   http.Handler
+	// Handles plain HTTP requests arriving on TLS listener, optional.
+	// Allows to answer ACME HTTP-01 challenges on the same port.
+	PlainHandler http.Handler
+	// Passes TLS connections not destined to udpierce to other backend,
+	// optional. Requires TLSConfig.
+	Mux *Mux
+	// Expects PROXY protocol header on connections from trusted
+	// proxies, optional
+	ProxyProtocol *TrustedProxy
+	ErrorLog      *log.Logger
+}
+
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	network := s.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network == "unix" {
+		if err := proto.RemoveStaleSocket(network, s.Addr); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen(network, s.Addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := proto.ChmodSocket(s.Addr, s.SocketMode); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serves connections accepted by listener until context is done
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	handler := s.Handler
+	if s.TLSConfig != nil && s.PlainHandler != nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.TLS == nil {
+				s.PlainHandler.ServeHTTP(w, req)
+			} else {
+				s.Handler.ServeHTTP(w, req)
+			}
+		})
+	}
+	srv := http.Server{
+		Addr:     s.Addr,
+		Handler:  handler,
+		ErrorLog: s.ErrorLog,
+		// Connections are hijacked, so HTTP/2 is never served even if
+		// negotiated with ALPN
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	// Config is used as is rather than cloned by ServeTLS, so later
+	// changes like session ticket keys rotation take effect
+	var preparers []connPreparer
+	if s.ProxyProtocol != nil {
+		preparers = append(preparers, s.ProxyProtocol.prepare)
+	}
+	switch {
+	case s.TLSConfig != nil && (s.PlainHandler != nil || s.Mux != nil):
+		sn := &sniffer{
+			cfg:   s.TLSConfig,
+			plain: s.PlainHandler != nil,
+			mux:   s.Mux,
+		}
+		preparers = append(preparers, sn.prepare)
+	case s.TLSConfig != nil && len(preparers) > 0:
+		preparers = append(preparers, func(conn net.Conn) net.Conn {
+			return tls.Server(conn, s.TLSConfig)
+		})
+	case s.TLSConfig != nil:
+		ln = tls.NewListener(ln, s.TLSConfig)
+	}
+	// Trust of proxy headers is decided by real TCP peer, which
+	// request remote address no longer tells after PROXY protocol
+	srv.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		return context.WithValue(ctx, peerAddrContextKey, conn.RemoteAddr())
+	}
+	if len(preparers) > 0 {
+		al := newAsyncListener(ln, chainPreparers(preparers...))
+		srv.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, peerAddrContextKey, al.peerAddr(conn))
+		}
+		ln = al
+	}
+	err := srv.Serve(ln)
+	if err == http.ErrServerClosed && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrDestinationMismatch = errors.New("Session is connected to other destination")
+
+// DgramConn is a datagram-oriented connection: each Read returns single
+// datagram and each Write sends single datagram
+type DgramConn interface {
+	io.ReadWriteCloser
+}
+
+// Sink delivers session datagrams to their destination
+type Sink interface {
+	// Returns datagram connection of session. All connections of the
+	// same session share single datagram connection.
+	ConnectSession(sess_id string) (DgramConn, error)
+	// Releases datagram connection obtained with ConnectSession
+	DisconnectSession(sess_id string)
+}
+
+// AddressedSink is implemented by sinks which assign network address
+// to each session. Address is reported to client in server hello.
+type AddressedSink interface {
+	Sink
+	// Returns address of connected session in CIDR notation or empty
+	// string if session has no address
+	SessionAddress(sess_id string) string
+}
+
+// DestinationSink is implemented by sinks which can forward session to
+// destination chosen by client
+type DestinationSink interface {
+	Sink
+	// Same as ConnectSession, but datagram connection is dialed to
+	// given destination. Connections of session share datagram
+	// connection dialed for first of them, connection requesting other
+	// destination fails with ErrDestinationMismatch.
+	ConnectSessionTo(sess_id, dst string) (DgramConn, error)
+}
+
+// SinkDialer opens new datagram connection for session
+type SinkDialer func(sess_id string) (DgramConn, error)
+
+type connEntry struct {
+	// Destination chosen by client, empty for default one
+	dst      string
+	conn     DgramConn
+	err      error
+	mux      sync.Mutex
+	refcount int
+}
+
+// SharedSink implements Sink on top of dialer. Datagram connection is
+// dialed on first connect of session and closed when last connection
+// of session is gone. Failed connect doesn't have to be disconnected.
+type SharedSink struct {
+	dial     SinkDialer
+	sessions map[string]*connEntry
+	sessmux  sync.Mutex
+}
+
+func NewSharedSink(dial SinkDialer) *SharedSink {
+	return &SharedSink{
+		dial:     dial,
+		sessions: make(map[string]*connEntry),
+	}
+}
+
+func (s *SharedSink) ConnectSession(sess_id string) (DgramConn, error) {
+	return s.connect(sess_id, "", s.dial)
+}
+
+// Connects session to destination dst dialed with dial, empty dst stands
+// for default destination
+func (s *SharedSink) connect(sess_id, dst string, dial SinkDialer) (DgramConn, error) {
+	s.sessmux.Lock()
+	entry, ok := s.sessions[sess_id]
+	if !ok {
+		entry = &connEntry{
+			dst:      dst,
+			refcount: 1,
+		}
+		entry.mux.Lock()
+		s.sessions[sess_id] = entry
+		s.sessmux.Unlock()
+		conn, err := dial(sess_id)
+		entry.conn, entry.err = conn, err
+		entry.mux.Unlock()
+		if err != nil {
+			s.DisconnectSession(sess_id)
+		}
+		return conn, err
+	} else if entry.dst != dst {
+		s.sessmux.Unlock()
+		return nil, ErrDestinationMismatch
+	} else {
+		s.sessmux.Unlock()
+		entry.mux.Lock()
+		entry.refcount++
+		conn, err := entry.conn, entry.err
+		entry.mux.Unlock()
+		if err != nil {
+			s.DisconnectSession(sess_id)
+		}
+		return conn, err
+	}
+}
+
+func (s *SharedSink) DisconnectSession(sess_id string) {
+	s.sessmux.Lock()
+	entry, ok := s.sessions[sess_id]
+	if ok {
+		entry.mux.Lock()
+		entry.refcount--
+		if entry.refcount < 1 {
+			delete(s.sessions, sess_id)
+		}
+		s.sessmux.Unlock()
+		if entry.refcount < 1 && entry.conn != nil {
+			entry.conn.Close()
+		}
+		entry.mux.Unlock()
+	} else {
+		s.sessmux.Unlock()
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSharedSinkDestination(t *testing.T) {
+	dials := 0
+	s := NewSharedSink(nil)
+	dial := func(_ string) (DgramConn, error) {
+		dials++
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	if _, err := s.connect("sess", "192.0.2.1:53", dial); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.connect("sess", "192.0.2.1:53", dial); err != nil {
+		t.Fatal(err)
+	}
+	if dials != 1 {
+		t.Fatalf("dialed %d times, want connection shared", dials)
+	}
+	for _, dst := range []string{"192.0.2.2:53", ""} {
+		if _, err := s.connect("sess", dst, dial); err != ErrDestinationMismatch {
+			t.Fatalf("connect to %q: got %v, want destination mismatch", dst, err)
+		}
+	}
+	s.DisconnectSession("sess")
+	s.DisconnectSession("sess")
+	if len(s.sessions) != 0 {
+		t.Fatal("session is left after last disconnect")
+	}
+}
+
+func TestSharedSinkFailedConnect(t *testing.T) {
+	fail := true
+	s := NewSharedSink(func(_ string) (DgramConn, error) {
+		if fail {
+			return nil, errors.New("connection refused")
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	if _, err := s.ConnectSession("sess"); err == nil {
+		t.Fatal("failed dial reported as success")
+	}
+	if len(s.sessions) != 0 {
+		t.Fatal("failed connect left session reference")
+	}
+	// Next connect dials again instead of reusing failure
+	fail = false
+	conn, err := s.ConnectSession("sess")
+	if err != nil || conn == nil {
+		t.Fatalf("got %v, %v after dial recovered", conn, err)
+	}
+	s.DisconnectSession("sess")
+}
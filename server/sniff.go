@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Time given to client to send first bytes of connection
+const SNIFF_TIMEOUT = 10 * time.Second
+
+// First byte of TLS handshake record
+const tlsRecordTypeHandshake = 0x16
+
+var errHelloRead = errors.New("ClientHello read")
+
+// peekedConn is a connection with some input already consumed from it
+// and kept in reader
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// helloConn feeds TLS handshake with connection input and discards
+// its output
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c helloConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// Reads ClientHello from connection. Returns connection which yields
+// same input again.
+func readClientHello(conn net.Conn) (*tls.ClientHelloInfo, net.Conn, error) {
+	var (
+		buf   bytes.Buffer
+		hello *tls.ClientHelloInfo
+	)
+	err := tls.Server(helloConn{conn, io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	replay := &peekedConn{conn, io.MultiReader(&buf, conn)}
+	if hello == nil {
+		return nil, replay, err
+	}
+	return hello, replay, nil
+}
+
+// sniffer tells TLS connections from plain ones by handshake record
+// type in first byte. TLS connections are returned as *tls.Conn. With
+// mux, connections not matched by it are passed to its backend instead.
+type sniffer struct {
+	cfg *tls.Config
+	// Accept plain connections, otherwise they are passed to mux
+	// backend or dropped if there is no mux
+	plain bool
+	mux   *Mux
+}
+
+func (s *sniffer) prepare(conn net.Conn) net.Conn {
+	conn.SetReadDeadline(time.Now().Add(SNIFF_TIMEOUT))
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+	var res net.Conn = &peekedConn{conn, r}
+	var emptytime time.Time
+	if first[0] != tlsRecordTypeHandshake {
+		res.SetReadDeadline(emptytime)
+		switch {
+		case s.plain:
+			return res
+		case s.mux != nil:
+			s.mux.pass(res)
+		default:
+			res.Close()
+		}
+		return nil
+	}
+	if s.mux != nil {
+		var hello *tls.ClientHelloInfo
+		hello, res, err = readClientHello(res)
+		res.SetReadDeadline(emptytime)
+		if err != nil {
+			// Let backend deal with malformed handshake
+			s.mux.pass(res)
+			return nil
+		}
+		if !s.mux.Matches(hello) {
+			s.mux.logger.Debug("Passing connection from %s with server name %q to backend",
+				conn.RemoteAddr(), hello.ServerName)
+			s.mux.pass(res)
+			return nil
+		}
+	}
+	res.SetReadDeadline(emptytime)
+	return tls.Server(res, s.cfg)
+}
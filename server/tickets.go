@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Snawoot/udpierce/proto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_TICKET_ROTATE = 12 * time.Hour
+
+// Amount of generated keys accepted for resumption: current one and
+// previous ones
+const TICKET_KEYS_KEEP = 3
+
+type TicketKeysOptions struct {
+	// File with shared ticket keys, optional. One hex-encoded 32-byte
+	// key per line, first one encrypts new tickets. If not set, keys
+	// are generated in memory.
+	File string
+	// Interval of key rotation or, with keys file, interval between
+	// checks of file for changes. Defaults to DEFAULT_TICKET_ROTATE.
+	Rotate time.Duration
+	Logger proto.Logger
+}
+
+// TicketKeys manages TLS session ticket keys of server config. Keys
+// shared across server fleet let clients resume sessions on any server.
+type TicketKeys struct {
+	cfg    *tls.Config
+	file   string
+	rotate time.Duration
+	logger proto.Logger
+	keys   [][32]byte
+	mtime  time.Time
+	mux    sync.Mutex
+}
+
+// Installs initial keys into config
+func NewTicketKeys(cfg *tls.Config, opts TicketKeysOptions) (*TicketKeys, error) {
+	rotate := opts.Rotate
+	if rotate <= 0 {
+		rotate = DEFAULT_TICKET_ROTATE
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = proto.NopLogger{}
+	}
+	k := &TicketKeys{
+		cfg:    cfg,
+		file:   opts.File,
+		rotate: rotate,
+		logger: logger,
+	}
+	var err error
+	if k.file != "" {
+		_, err = k.reload()
+	} else {
+		err = k.generate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotates or reloads keys until context is done
+func (k *TicketKeys) Run(ctx context.Context) {
+	ticker := time.NewTicker(k.rotate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if k.file == "" {
+			if err := k.generate(); err != nil {
+				k.logger.Error("Ticket key rotation failed: %v", err)
+			} else {
+				k.logger.Info("Session ticket key rotated")
+			}
+			continue
+		}
+		changed, err := k.reload()
+		if err != nil {
+			k.logger.Error("Ticket keys reload failed, keeping previous keys: %v", err)
+		} else if changed {
+			k.logger.Info("Session ticket keys reloaded from %s", k.file)
+		}
+	}
+}
+
+func (k *TicketKeys) generate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	keys := append([][32]byte{key}, k.keys...)
+	if len(keys) > TICKET_KEYS_KEEP {
+		keys = keys[:TICKET_KEYS_KEEP]
+	}
+	k.keys = keys
+	k.cfg.SetSessionTicketKeys(keys)
+	return nil
+}
+
+func (k *TicketKeys) reload() (bool, error) {
+	fi, err := os.Stat(k.file)
+	if err != nil {
+		return false, err
+	}
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if fi.ModTime().Equal(k.mtime) {
+		return false, nil
+	}
+	keys, err := loadTicketKeys(k.file)
+	if err != nil {
+		return false, err
+	}
+	k.keys = keys
+	k.mtime = fi.ModTime()
+	k.cfg.SetSessionTicketKeys(keys)
+	return true, nil
+}
+
+// Reads hex-encoded keys from file. Empty lines and lines starting
+// with '#' are ignored.
+func loadTicketKeys(filename string) ([][32]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys [][32]byte
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%s:%d: expected 64 hex digits", filename, lineno)
+		}
+		var key [32]byte
+		copy(key[:], b)
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("No keys in ticket keys file " + filename)
+	}
+	return keys, nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/Snawoot/udpierce/proto"
+	"io/ioutil"
+)
+
+// Builds TLS config with given certificate. If CA file is specified,
+// client certificates are verified against CAs from it. Handshake
+// parameters are optional.
+func NewTLSConfig(certfile, keyfile, cafile string, params *proto.TLSParams) (*tls.Config, error) {
+	var cfg tls.Config
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	if err := setClientCAs(&cfg, cafile); err != nil {
+		return nil, err
+	}
+	params.Apply(&cfg)
+	return &cfg, nil
+}
+
+func loadCertPool(cafile string) (*x509.CertPool, error) {
+	roots := x509.NewCertPool()
+	certs, err := ioutil.ReadFile(cafile)
+	if err != nil {
+		return nil, err
+	}
+	if ok := roots.AppendCertsFromPEM(certs); !ok {
+		return nil, errors.New("Failed to load CA certificates")
+	}
+	return roots, nil
+}
+
+func setClientCAs(cfg *tls.Config, cafile string) error {
+	if cafile == "" {
+		return nil
+	}
+	roots, err := loadCertPool(cafile)
+	if err != nil {
+		return err
+	}
+	cfg.ClientCAs = roots
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/Snawoot/udpierce/proto"
+	"github.com/Snawoot/udpierce/tun"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const DEFAULT_LEASE_TIME = 5 * time.Minute
+
+type TUNSinkOptions struct {
+	// Interface name. Empty name lets kernel pick one.
+	Name string
+	// Network to assign session addresses from, optional. First host
+	// address is assigned to interface itself. If not set, interface
+	// has to be configured by other means.
+	Pool *net.IPNet
+	// Interface MTU. Zero leaves it intact.
+	MTU int
+	// Time address remains reserved for disconnected session.
+	// Defaults to DEFAULT_LEASE_TIME.
+	LeaseTime time.Duration
+	Logger    proto.Logger
+}
+
+// TUNSink delivers session datagrams as IP packets into TUN interface.
+// With address pool each session is assigned own address. Otherwise
+// session is pinned to first source address it sends packets from,
+// unless other session holds that address. Packets from other source
+// addresses are dropped and packets read from interface are routed to
+// session holding their destination address.
+type TUNSink struct {
+	*SharedSink
+	dev    *tun.Device
+	pool   *addrPool
+	logger proto.Logger
+	routes map[string]*tunConn
+	mux    sync.RWMutex
+}
+
+func NewTUNSink(ctx context.Context, opts TUNSinkOptions) (*TUNSink, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = proto.NopLogger{}
+	}
+	leaseTime := opts.LeaseTime
+	if leaseTime <= 0 {
+		leaseTime = DEFAULT_LEASE_TIME
+	}
+	var pool *addrPool
+	if opts.Pool != nil {
+		var err error
+		pool, err = newAddrPool(opts.Pool, leaseTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dev, err := tun.Open(opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	if pool != nil || opts.MTU > 0 {
+		err = dev.Up(opts.MTU)
+		if err == nil && pool != nil {
+			err = dev.AddAddress(pool.Gateway())
+		}
+		if err != nil {
+			dev.Close()
+			return nil, err
+		}
+	}
+	s := &TUNSink{
+		dev:    dev,
+		pool:   pool,
+		logger: logger,
+		routes: make(map[string]*tunConn),
+	}
+	s.SharedSink = NewSharedSink(s.dialSession)
+	go func() {
+		<-ctx.Done()
+		dev.Close()
+	}()
+	go s.readLoop()
+	return s, nil
+}
+
+// Name of TUN interface
+func (s *TUNSink) Name() string {
+	return s.dev.Name()
+}
+
+// Returns address assigned to session in CIDR notation or empty string
+// if sink has no address pool
+func (s *TUNSink) SessionAddress(sess_id string) string {
+	if s.pool == nil {
+		return ""
+	}
+	addr := s.pool.Lookup(sess_id)
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func (s *TUNSink) dialSession(sess_id string) (DgramConn, error) {
+	conn := &tunConn{
+		sink: s,
+		id:   sess_id,
+		rx:   make(chan []byte, PIPE_QLEN),
+		done: make(chan struct{}),
+	}
+	if s.pool != nil {
+		addr, err := s.pool.Acquire(sess_id)
+		if err != nil {
+			return nil, err
+		}
+		conn.addr = addr.IP
+		if !s.route(addr.IP.String(), conn) {
+			s.pool.Release(sess_id)
+			return nil, fmt.Errorf("address %s is routed to other session", addr.IP)
+		}
+	}
+	return conn, nil
+}
+
+func (s *TUNSink) readLoop() {
+	buf := make([]byte, proto.DGRAM_BUF)
+	for {
+		n, err := s.dev.Read(buf)
+		if err != nil {
+			s.logger.Error("TUN read error: %v", err)
+			return
+		}
+		_, dst, ok := tun.PacketAddrs(buf[:n])
+		if !ok {
+			continue
+		}
+		s.mux.RLock()
+		conn := s.routes[dst.String()]
+		s.mux.RUnlock()
+		if conn == nil {
+			s.logger.Debug("No session for TUN packet to %s", dst)
+			continue
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		select {
+		case conn.rx <- pkt:
+		default:
+		}
+	}
+}
+
+// Binds address to session, so packets destined to it are delivered
+// to that session. Address bound to other session isn't taken over.
+func (s *TUNSink) route(addr string, conn *tunConn) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if cur, ok := s.routes[addr]; ok {
+		return cur == conn
+	}
+	s.routes[addr] = conn
+	s.logger.Info("Address %s is now routed to session %s", addr, conn.id)
+	return true
+}
+
+func (s *TUNSink) unroute(conn *tunConn) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for addr, c := range s.routes {
+		if c == conn {
+			delete(s.routes, addr)
+		}
+	}
+}
+
+type tunConn struct {
+	sink *TUNSink
+	id   string
+	// Source address of session, either assigned from pool or pinned
+	// on first write
+	addr      net.IP
+	addrMux   sync.Mutex
+	rx        chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *tunConn) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-c.rx:
+		return copy(b, pkt), nil
+	case <-c.done:
+		return 0, io.EOF
+	}
+}
+
+func (c *tunConn) Write(b []byte) (int, error) {
+	src, _, ok := tun.PacketAddrs(b)
+	if !ok {
+		// Not an IP packet, skip it
+		return len(b), nil
+	}
+	if !c.allowedSource(src) {
+		c.sink.logger.Debug("Dropped packet of session %s: source address %s is not assigned to it", c.id, src)
+		return len(b), nil
+	}
+	return c.sink.dev.Write(b)
+}
+
+// Pins session to its first source address if it has none yet
+func (c *tunConn) allowedSource(src net.IP) bool {
+	c.addrMux.Lock()
+	defer c.addrMux.Unlock()
+	if c.addr == nil {
+		if !c.sink.route(src.String(), c) {
+			return false
+		}
+		// Source address points into packet buffer
+		c.addr = append(net.IP(nil), src...)
+	}
+	return c.addr.Equal(src)
+}
+
+func (c *tunConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.sink.unroute(c)
+		if c.sink.pool != nil {
+			c.sink.pool.Release(c.id)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Builds IPv4 header with given addresses followed by payload
+func ipv4Packet(src, dst string, payload []byte) []byte {
+	pkt := make([]byte, 20+len(payload))
+	pkt[0] = 0x45
+	pkt[2], pkt[3] = byte(len(pkt)>>8), byte(len(pkt))
+	pkt[8] = 64
+	pkt[9] = syscall.IPPROTO_UDP
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	copy(pkt[20:], payload)
+	return pkt
+}
+
+// Sends UDP datagram from interface address to dst and expects it to
+// come out of session conn
+func expectDelivery(t *testing.T, conn DgramConn, dst string) {
+	t.Helper()
+	sender, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(dst), Port: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan net.IP, 1)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if n >= 20 && buf[0]>>4 == 4 {
+				got <- append(net.IP(nil), buf[16:20]...)
+				return
+			}
+		}
+	}()
+	select {
+	case ip := <-got:
+		if !ip.Equal(net.ParseIP(dst)) {
+			t.Fatalf("session got packet to %s, want %s", ip, dst)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("packet to %s isn't delivered to session", dst)
+	}
+}
+
+func TestTUNSinkSourcePinning(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	// Thread stays in its own network namespace and exits with test
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		t.Skipf("can't create network namespace: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink, err := NewTUNSink(ctx, TUNSinkOptions{MTU: 1400})
+	if err != nil {
+		t.Skipf("can't create TUN interface: %v", err)
+	}
+	gw := &net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}
+	if err := sink.dev.AddAddress(gw); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := sink.ConnectSession("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.DisconnectSession("a")
+	b, err := sink.ConnectSession("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.DisconnectSession("b")
+
+	a.Write(ipv4Packet("10.0.0.2", "10.0.0.1", nil))
+	// Address of other session isn't taken over
+	b.Write(ipv4Packet("10.0.0.2", "10.0.0.1", nil))
+	b.Write(ipv4Packet("10.0.0.3", "10.0.0.1", nil))
+	// Pinned session can't use other address
+	a.Write(ipv4Packet("10.0.0.9", "10.0.0.1", nil))
+
+	sink.mux.RLock()
+	routes := make(map[string]*tunConn)
+	for addr, conn := range sink.routes {
+		routes[addr] = conn
+	}
+	sink.mux.RUnlock()
+	if len(routes) != 2 || routes["10.0.0.2"] != a || routes["10.0.0.3"] != b {
+		t.Fatalf("got routes %v, want 10.0.0.2 to a and 10.0.0.3 to b", routes)
+	}
+	expectDelivery(t, a, "10.0.0.2")
+	expectDelivery(t, b, "10.0.0.3")
+}
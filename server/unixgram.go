@@ -0,0 +1,41 @@
+package server
+
+import (
+	"github.com/Snawoot/udpierce/proto"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Unix datagram socket bound to own filesystem path, so destination
+// can send replies. Path is removed on close.
+type unixgramConn struct {
+	*net.UnixConn
+	path string
+}
+
+func dialUnixgram(address, sess_id string, mode os.FileMode) (DgramConn, error) {
+	laddr := &net.UnixAddr{
+		Name: filepath.Join(os.TempDir(), "udpierce-"+sess_id+".sock"),
+		Net:  "unixgram",
+	}
+	os.Remove(laddr.Name)
+	raddr := &net.UnixAddr{Name: address, Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", laddr, raddr)
+	if err != nil {
+		os.Remove(laddr.Name)
+		return nil, err
+	}
+	if err := proto.ChmodSocket(laddr.Name, mode); err != nil {
+		conn.Close()
+		os.Remove(laddr.Name)
+		return nil, err
+	}
+	return &unixgramConn{conn, laddr.Name}, nil
+}
+
+func (c *unixgramConn) Close() error {
+	err := c.UnixConn.Close()
+	os.Remove(c.path)
+	return err
+}
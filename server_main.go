@@ -1,6 +1,14 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"github.com/Snawoot/udpierce/acl"
+	"github.com/Snawoot/udpierce/client"
+	"github.com/Snawoot/udpierce/pki"
+	"github.com/Snawoot/udpierce/proto"
+	"github.com/Snawoot/udpierce/resolver"
+	"github.com/Snawoot/udpierce/server"
 	"log"
 	"net/http"
 	"os"
@@ -17,31 +25,281 @@ func server_main(args *CLIArgs) int {
 	handlerLogger := NewCondLogger(log.New(logWriter, "HANDLER : ",
 		log.LstdFlags|log.Lshortfile),
 		args.verbosity)
-	endpoint, err := NewDgramEndpoint(args.dst, args.timeout, args.resolve_once)
+	aclLogger := NewCondLogger(log.New(logWriter, "ACL     : ",
+		log.LstdFlags|log.Lshortfile),
+		args.verbosity)
+	ctx, cancel := signalContext()
+	defer cancel()
+	peerACL, err := acl.New(args.allowList, args.denyList, aclLogger)
+	if err != nil {
+		mainLogger.Critical("ACL construction failed: %v", err)
+		return 3
+	}
+	go peerACL.Watch(ctx, args.aclReload)
+	dstACL, err := acl.New(args.dstAllowList, args.dstDenyList, aclLogger)
+	if err != nil {
+		mainLogger.Critical("Destination ACL construction failed: %v", err)
+		return 3
+	}
+	go dstACL.Watch(ctx, args.aclReload)
+	if args.dynamicDst && dstACL == nil {
+		mainLogger.Warning("Clients may choose any destination: consider restricting them with -dst-allow-list")
+	}
+	sinkLogger := NewCondLogger(log.New(logWriter, "SINK    : ",
+		log.LstdFlags|log.Lshortfile),
+		args.verbosity)
+	dnsLogger := NewCondLogger(log.New(logWriter, "DNS     : ",
+		log.LstdFlags|log.Lshortfile),
+		args.verbosity)
+	res, err := makeResolver(args, dnsLogger)
+	if err != nil {
+		mainLogger.Critical("Resolver construction failed: %v", err)
+		return 3
+	}
+	endpoint, err := makeSink(ctx, args, res, sinkLogger)
 	if err != nil {
 		mainLogger.Critical("Endpoint construction failed: %v", err)
+		return 3
+	}
+	var hmacAuth *proto.HMACVerifier
+	if args.authScheme == proto.AUTH_HMAC {
+		hmacAuth, err = proto.NewHMACVerifier(args.password, args.usersFile, args.authSkew)
+		if err != nil {
+			mainLogger.Critical("Authentication setup failed: %v", err)
+			return 3
+		}
+	}
+	var crypter *proto.FrameCrypter
+	if args.psk != "" {
+		crypter = proto.NewFrameCrypter(args.psk)
+	}
+	padding, err := proto.NewPadding(args.padMode, args.padSize, args.coverInterval)
+	if err != nil {
+		mainLogger.Critical("Padding setup failed: %v", err)
+		return 3
+	}
+	hello, err := proto.NewResponseTemplate(args.helloStatus, args.helloHeaders.Header(), args.helloDate)
+	if err != nil {
+		mainLogger.Critical("Server response setup failed: %v", err)
+		return 3
+	}
+	var identities *server.CertIdentities
+	if args.certIdentities != "" {
+		identities, err = server.NewCertIdentities(args.certIdentities, aclLogger)
+		if err != nil {
+			mainLogger.Critical("Certificate identities loading failed: %v", err)
+			return 3
+		}
+		go identities.Watch(ctx, args.aclReload)
+	}
+	var crl *server.CRL
+	if args.crlFile != "" {
+		crlLogger := NewCondLogger(log.New(logWriter, "CRL     : ",
+			log.LstdFlags|log.Lshortfile),
+			args.verbosity)
+		crl, err = server.NewCRL(server.CRLOptions{
+			File:   args.crlFile,
+			CAFile: args.cafile,
+			Reload: args.aclReload,
+			Logger: crlLogger,
+		})
+		if err != nil {
+			mainLogger.Critical("CRL loading failed: %v", err)
+			return 3
+		}
+		go crl.Run(ctx)
 	}
-	handler := NewServerHandler(args.password,
-		endpoint,
-		(args.tls && args.cafile != ""),
-		handlerLogger)
+	var handler http.Handler = server.NewHandler(ctx, endpoint, server.HandlerOptions{
+		Request: proto.NewRequestTemplate(args.httpMethod, args.httpPath, "",
+			args.headerPrefix, nil),
+		Hello:          hello,
+		Password:       args.password,
+		HMACAuth:       hmacAuth,
+		Crypter:        crypter,
+		Padding:        padding,
+		RequireTLSAuth: args.cafile != "" && (args.tls || args.clientCertHeader != ""),
+		Identities:     identities,
+		ACL:            peerACL,
+		DynamicDst:     args.dynamicDst,
+		DstACL:         dstACL,
+		Logger:         handlerLogger,
+	})
 
-	var server http.Server
-	server.Addr = args.bind
-	server.Handler = handler
-	server.ErrorLog = log.New(logWriter, "HTTPSRV : ", log.LstdFlags|log.Lshortfile)
+	var trustedProxy *server.TrustedProxy
+	if args.proxyProtocol || args.forwardedFor || args.clientCertHeader != "" {
+		proxyLogger := NewCondLogger(log.New(logWriter, "PROXY   : ",
+			log.LstdFlags|log.Lshortfile),
+			args.verbosity)
+		proxyOpts := server.TrustedProxyOptions{
+			Networks:     args.trustedProxies,
+			TrustUnix:    args.trustUnixPeers,
+			ForwardedFor: args.forwardedFor,
+			CertHeader:   args.clientCertHeader,
+			CAFile:       args.cafile,
+			Logger:       proxyLogger,
+		}
+		if crl != nil {
+			proxyOpts.VerifyChains = crl.VerifyChains
+		}
+		trustedProxy, err = server.NewTrustedProxy(proxyOpts)
+		if err != nil {
+			mainLogger.Critical("Trusted proxy setup failed: %v", err)
+			return 3
+		}
+		if args.forwardedFor || args.clientCertHeader != "" {
+			handler = trustedProxy.Wrap(handler)
+		}
+	}
+
+	network, bindAddr := splitScheme(args.bind, "tcp", "tcp", "unix")
+	srv := server.Server{
+		Addr:       bindAddr,
+		Network:    network,
+		SocketMode: os.FileMode(args.socketMode),
+		Handler:    handler,
+		ErrorLog:   log.New(logWriter, "HTTPSRV : ", log.LstdFlags|log.Lshortfile),
+	}
+	if args.proxyProtocol {
+		srv.ProxyProtocol = trustedProxy
+	}
 	if args.tls {
-		cfg, err := makeServerTLSConfig(args.cert, args.key, args.cafile)
+		if args.selfSigned {
+			hostname, err := os.Hostname()
+			if err != nil || hostname == "" {
+				hostname = "localhost"
+			}
+			cert, created, err := pki.EnsureSelfSigned(args.cert, args.key, []string{hostname})
+			if err != nil {
+				mainLogger.Critical("Self-signed certificate setup failed: %v", err)
+				return 3
+			}
+			if created {
+				mainLogger.Info("Generated self-signed certificate %s with key %s", args.cert, args.key)
+			}
+			pin := pki.SPKIFingerprint(cert)
+			mainLogger.Info("Server certificate public key pin: %s", pin)
+			mainLogger.Info("Client options for this server: -pin-sha256 %s -hostname-check=false", pin)
+		}
+		var cfg *tls.Config
+		if args.acmeHosts != "" {
+			manager, err := server.NewACMEManager(server.ACMEOptions{
+				Hosts:        splitList(args.acmeHosts),
+				CacheDir:     args.acmeCache,
+				DirectoryURL: args.acmeDirectory,
+				Email:        args.acmeEmail,
+				CAFile:       args.acmeCAFile,
+			})
+			if err != nil {
+				mainLogger.Critical("ACME setup failed: %v", err)
+				return 3
+			}
+			cfg, err = server.NewACMETLSConfig(manager, args.cafile, args.tlsParams)
+			if err != nil {
+				mainLogger.Critical("TLS config construction failed: %v", err)
+				return 3
+			}
+			srv.PlainHandler = manager.HTTPHandler(nil)
+		} else {
+			cfg, err = server.NewTLSConfig(args.cert, args.key, args.cafile, args.tlsParams)
+			if err != nil {
+				mainLogger.Critical("TLS config construction failed: %v", err)
+				return 3
+			}
+		}
+		if crl != nil {
+			cfg.VerifyConnection = crl.VerifyConnection
+		}
+		ticketsLogger := NewCondLogger(log.New(logWriter, "TICKETS : ",
+			log.LstdFlags|log.Lshortfile),
+			args.verbosity)
+		tickets, err := server.NewTicketKeys(cfg, server.TicketKeysOptions{
+			File:   args.ticketKeysFile,
+			Rotate: args.ticketRotate,
+			Logger: ticketsLogger,
+		})
 		if err != nil {
-			mainLogger.Critical("TLS config construction failed: %v", err)
+			mainLogger.Critical("TLS session ticket keys setup failed: %v", err)
 			return 3
 		}
-		server.TLSConfig = cfg
-		err = server.ListenAndServeTLS("", "")
-	} else {
-		err = server.ListenAndServe()
+		go tickets.Run(ctx)
+		srv.TLSConfig = cfg
+		if args.muxBackend != "" {
+			muxLogger := NewCondLogger(log.New(logWriter, "MUX     : ",
+				log.LstdFlags|log.Lshortfile),
+				args.verbosity)
+			srv.Mux = server.NewMux(server.MuxOptions{
+				ServerNames: splitList(args.muxServerNames),
+				ALPN:        splitList(args.muxALPN),
+				Backend:     args.muxBackend,
+				Timeout:     args.timeout,
+				Logger:      muxLogger,
+			})
+		}
+	}
+	err = srv.ListenAndServe(ctx)
+	if err != ctx.Err() {
+		mainLogger.Critical("Server terminated with a reason: %v", err)
 	}
-	mainLogger.Critical("Server terminated with a reason: %v", err)
 	mainLogger.Info("Shutting down...")
 	return 0
 }
+
+// Schemes of server destination
+var sinkSchemes = []string{"udp", "unixgram", "tun", "chain"}
+
+// Builds sink for destination specified as [scheme:]address
+func makeSink(ctx context.Context, args *CLIArgs, res *resolver.Resolver, logger *CondLogger) (server.Sink, error) {
+	scheme, address := splitScheme(args.dst, "udp", sinkSchemes...)
+	switch scheme {
+	case "tun":
+		sink, err := server.NewTUNSink(ctx, server.TUNSinkOptions{
+			Name:   address,
+			Pool:   args.tunPool.IPNet,
+			MTU:    args.tunMTU,
+			Logger: logger,
+		})
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Using TUN interface %s", sink.Name())
+		return sink, nil
+	case "chain":
+		connFactory, err := client.NewConnFactory(client.ConnFactoryOptions{
+			Address:          address,
+			Timeout:          args.timeout,
+			DisableTLS:       !args.chainTLS,
+			CAFile:           args.chainCAFile,
+			Dialers:          args.dialers,
+			Resolver:         res,
+			SocketOptions:    args.sockopts,
+			BreakerThreshold: args.breakerThreshold,
+			BreakerTimeout:   args.breakerTimeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		auth, err := proto.NewClientAuth(args.chainAuth, args.chainUsername, args.chainPassword)
+		if err != nil {
+			return nil, err
+		}
+		var crypter *proto.FrameCrypter
+		if args.chainPSK != "" {
+			crypter = proto.NewFrameCrypter(args.chainPSK)
+		}
+		return server.NewChainSink(ctx, client.NewSessionFactory(connFactory, client.SessionOptions{
+			Auth:       auth,
+			Crypter:    crypter,
+			Backoff:    args.backoff,
+			MaxBackoff: args.maxBackoff,
+			Conns:      args.conns,
+			Logger:     logger,
+		})), nil
+	}
+	endpoint, err := server.NewDgramEndpoint(scheme, address, args.timeout, args.resolve_once, res)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.SocketMode = os.FileMode(args.dstSocketMode)
+	endpoint.SocketOptions = args.sockopts
+	return endpoint, nil
+}
@@ -0,0 +1,29 @@
+// Package tun provides access to layer-3 TUN network interfaces
+package tun
+
+import (
+	"errors"
+	"net"
+)
+
+var ErrUnsupported = errors.New("TUN interfaces are supported only on Linux")
+
+// Returns source and destination addresses of raw IP packet
+func PacketAddrs(pkt []byte) (src, dst net.IP, ok bool) {
+	if len(pkt) < 1 {
+		return nil, nil, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil, nil, false
+		}
+		return net.IP(pkt[12:16]), net.IP(pkt[16:20]), true
+	case 6:
+		if len(pkt) < 40 {
+			return nil, nil, false
+		}
+		return net.IP(pkt[8:24]), net.IP(pkt[24:40]), true
+	}
+	return nil, nil, false
+}
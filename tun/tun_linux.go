@@ -0,0 +1,97 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const ifReqSize = 40
+
+// Device is an open TUN interface. Each Read and Write transfers
+// single IP packet without additional headers.
+type Device struct {
+	*os.File
+	name string
+}
+
+// Creates TUN interface or attaches to existing one. Empty name lets
+// kernel pick one.
+func Open(name string) (*Device, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	var req [ifReqSize]byte
+	copy(req[:syscall.IFNAMSIZ-1], name)
+	*(*uint16)(unsafe.Pointer(&req[syscall.IFNAMSIZ])) = syscall.IFF_TUN | syscall.IFF_NO_PI
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(syscall.TUNSETIFF), uintptr(unsafe.Pointer(&req[0])))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	// Non-blocking descriptor is served by runtime poller, so Close
+	// interrupts pending Read
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	ifname := string(req[:clen(req[:syscall.IFNAMSIZ])])
+	return &Device{
+		File: os.NewFile(uintptr(fd), "/dev/net/tun"),
+		name: ifname,
+	}, nil
+}
+
+func (d *Device) Name() string {
+	return d.name
+}
+
+func clen(b []byte) int {
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// Sets MTU of interface and brings it up. Zero MTU leaves it intact.
+func (d *Device) Up(mtu int) error {
+	if mtu > 0 {
+		if err := ipCmd("link", "set", "dev", d.name, "mtu", strconv.Itoa(mtu)); err != nil {
+			return err
+		}
+	}
+	return ipCmd("link", "set", "dev", d.name, "up")
+}
+
+// Assigns address to interface
+func (d *Device) AddAddress(addr *net.IPNet) error {
+	return ipCmd("addr", "replace", addr.String(), "dev", d.name)
+}
+
+// Removes address from interface
+func (d *Device) DelAddress(addr *net.IPNet) error {
+	return ipCmd("addr", "del", addr.String(), "dev", d.name)
+}
+
+// Routes network through interface
+func (d *Device) AddRoute(dst *net.IPNet) error {
+	return ipCmd("route", "replace", dst.String(), "dev", d.name)
+}
+
+// Interfaces are configured with ip utility from iproute2
+func ipCmd(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
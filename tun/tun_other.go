@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+package tun
+
+import (
+	"net"
+	"os"
+)
+
+type Device struct {
+	*os.File
+	name string
+}
+
+func Open(name string) (*Device, error) {
+	return nil, ErrUnsupported
+}
+
+func (d *Device) Name() string {
+	return d.name
+}
+
+func (d *Device) Up(mtu int) error {
+	return ErrUnsupported
+}
+
+func (d *Device) AddAddress(addr *net.IPNet) error {
+	return ErrUnsupported
+}
+
+func (d *Device) DelAddress(addr *net.IPNet) error {
+	return ErrUnsupported
+}
+
+func (d *Device) AddRoute(dst *net.IPNet) error {
+	return ErrUnsupported
+}